@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// authorizationKey is the metadata key of the credentials of a request
+const authorizationKey = "authorization"
+
+// Principal represents an authenticated caller
+type Principal struct {
+	// Name identifies the caller, it is the user name or the name of the token
+	Name string
+	Role Role
+}
+
+type principalKey struct{}
+
+// NewContext returns a copy of ctx carrying the principal
+func NewContext(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// FromContext returns the principal carried by ctx and whether there is one
+func FromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// User represents an account that authenticates with a password
+type User struct {
+	Name     string
+	Password string
+	Role     Role
+}
+
+// Authenticator checks the credentials sent in the authorization metadata of the requests:
+// basic credentials of a user, a static bearer token or a bearer token issued by Login
+type Authenticator struct {
+	users map[string]User
+	// tokens maps the static bearer tokens to their principals
+	tokens map[string]Principal
+	// issuer issues and verifies the tokens of Login, nil when Login is disabled
+	issuer *Issuer
+}
+
+// NewAuthenticator returns authenticator of the users, of the static bearer tokens and of the
+// tokens of the issuer, which may be nil
+func NewAuthenticator(users []User, tokens map[string]Principal, issuer *Issuer) *Authenticator {
+	a := &Authenticator{users: map[string]User{}, tokens: tokens, issuer: issuer}
+	for _, user := range users {
+		if user.Name != "" && user.Password != "" {
+			a.users[user.Name] = user
+		}
+	}
+	return a
+}
+
+// ParseUsers parses a comma separated list of name:password:role users
+func ParseUsers(value string) ([]User, error) {
+	users := []User{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		// the password may contain colons
+		name, rest, _ := cut(entry, ":")
+		separator := strings.LastIndex(rest, ":")
+		if name == "" || separator <= 0 {
+			return nil, fmt.Errorf("invalid user %q, expected name:password:role", name)
+		}
+		role, err := ParseRole(rest[separator+1:])
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, User{Name: name, Password: rest[:separator], Role: role})
+	}
+	return users, nil
+}
+
+// ParseTokens parses a comma separated list of name:token:role static tokens, the role is
+// admin when it is omitted
+func ParseTokens(value string) (map[string]Principal, error) {
+	tokens := map[string]Principal{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid token of %q, expected name:token:role", parts[0])
+		}
+		principal := Principal{Name: parts[0], Role: Admin}
+		if len(parts) == 3 {
+			role, err := ParseRole(parts[2])
+			if err != nil {
+				return nil, err
+			}
+			principal.Role = role
+		}
+		tokens[parts[1]] = principal
+	}
+	return tokens, nil
+}
+
+// Enabled reports whether any credentials are accepted
+func (a *Authenticator) Enabled() bool {
+	return len(a.users) > 0 || len(a.tokens) > 0 || a.issuer != nil
+}
+
+// Login returns a signed token of the user with the password and its expiration time, the
+// error is an Unauthenticated status when the credentials are wrong
+func (a *Authenticator) Login(username, password string) (string, time.Time, Principal, error) {
+	if a.issuer == nil {
+		return "", time.Time{}, Principal{}, status.Error(codes.Unimplemented, "Login is not enabled, no token signing key is configured")
+	}
+
+	principal, err := a.checkPassword(username, password)
+	if err != nil {
+		return "", time.Time{}, Principal{}, err
+	}
+	token, expiresAt, err := a.issuer.Issue(principal)
+	if err != nil {
+		return "", time.Time{}, Principal{}, status.Errorf(codes.Internal, fmt.Sprintf("Token cannot be issued: %v", err))
+	}
+	return token, expiresAt, principal, nil
+}
+
+// Authenticate returns the principal of the credentials of the request, the error is an
+// Unauthenticated status when they are missing or wrong
+func (a *Authenticator) Authenticate(ctx context.Context) (Principal, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(authorizationKey)
+	if len(values) == 0 {
+		return Principal{}, status.Error(codes.Unauthenticated, "Missing credentials")
+	}
+
+	scheme, credentials, _ := cut(values[0], " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		return a.basic(credentials)
+	case "bearer":
+		return a.bearer(credentials)
+	default:
+		return Principal{}, status.Errorf(codes.Unauthenticated, fmt.Sprintf("Unsupported authorization scheme: %s", scheme))
+	}
+}
+
+// basic checks the encoded user:password credentials
+func (a *Authenticator) basic(credentials string) (Principal, error) {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return Principal{}, status.Error(codes.Unauthenticated, "Malformed basic credentials")
+	}
+	username, password, ok := cut(string(decoded), ":")
+	if !ok {
+		return Principal{}, status.Error(codes.Unauthenticated, "Malformed basic credentials")
+	}
+	return a.checkPassword(username, password)
+}
+
+// checkPassword returns the principal of the user when the password is right
+func (a *Authenticator) checkPassword(username, password string) (Principal, error) {
+	user, ok := a.users[username]
+	// the password is compared even for unknown users so the timing doesn't tell them apart
+	if subtle.ConstantTimeCompare([]byte(password), []byte(user.Password)) != 1 || !ok {
+		return Principal{}, status.Error(codes.Unauthenticated, "Invalid username or password")
+	}
+	return Principal{Name: user.Name, Role: user.Role}, nil
+}
+
+// bearer checks a static token or a token issued by Login
+func (a *Authenticator) bearer(token string) (Principal, error) {
+	token = strings.TrimSpace(token)
+	for known, principal := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			return principal, nil
+		}
+	}
+	if a.issuer != nil {
+		if principal, err := a.issuer.Verify(token); err == nil {
+			return principal, nil
+		}
+	}
+	return Principal{}, status.Error(codes.Unauthenticated, "Invalid or expired token")
+}
+
+// cut slices s around the first separator and reports whether it was found
+func cut(s, sep string) (string, string, bool) {
+	parts := strings.SplitN(s, sep, 2)
+	if len(parts) < 2 {
+		return s, "", false
+	}
+	return parts[0], parts[1], true
+}
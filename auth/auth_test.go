@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// incoming returns the server context of a request sent with the credentials
+func incoming(t *testing.T, creds credentials.PerRPCCredentials) context.Context {
+	t.Helper()
+	md, err := creds.GetRequestMetadata(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metadata.NewIncomingContext(context.Background(), metadata.New(md))
+}
+
+func newTestAuthenticator(t *testing.T, ttl time.Duration) *Authenticator {
+	t.Helper()
+	users, err := ParseUsers("nadir:password:admin, vera:pass:word:viewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := ParseTokens("ci:s3cret:editor, deploy:t0ken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := NewHMACIssuer([]byte("0123456789abcdef0123456789abcdef"), "test", ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAuthenticator(users, tokens, issuer)
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := newTestAuthenticator(t, time.Hour)
+	token, _, _, err := a.Login("vera", "pass:word")
+	if err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want Principal
+		code codes.Code
+	}{
+		{"basic", incoming(t, BasicCredentials{Username: "nadir", Password: "password"}), Principal{"nadir", Admin}, codes.OK},
+		{"wrong password", incoming(t, BasicCredentials{Username: "nadir", Password: "secret"}), Principal{}, codes.Unauthenticated},
+		{"static token", incoming(t, TokenCredentials{Token: "s3cret"}), Principal{"ci", Editor}, codes.OK},
+		{"static token default role", incoming(t, TokenCredentials{Token: "t0ken"}), Principal{"deploy", Admin}, codes.OK},
+		{"issued token", incoming(t, TokenCredentials{Token: token}), Principal{"vera", Viewer}, codes.OK},
+		{"tampered token", incoming(t, TokenCredentials{Token: token + "x"}), Principal{}, codes.Unauthenticated},
+		{"missing", context.Background(), Principal{}, codes.Unauthenticated},
+		{"unknown scheme", metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Digest abc")), Principal{}, codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := a.Authenticate(tt.ctx)
+			if status.Code(err) != tt.code || principal != tt.want {
+				t.Errorf("Authenticate() = %+v, %v, want %+v, %v", principal, err, tt.want, tt.code)
+			}
+		})
+	}
+}
+
+func TestLoginExpiredToken(t *testing.T) {
+	a := newTestAuthenticator(t, -time.Minute)
+	if _, _, _, err := a.Login("nadir", "wrong"); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Login() with wrong password code = %v, want %v", status.Code(err), codes.Unauthenticated)
+	}
+
+	token, _, _, err := a.Login("nadir", "password")
+	if err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	if _, err := a.Authenticate(incoming(t, TokenCredentials{Token: token})); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Authenticate() with expired token code = %v, want %v", status.Code(err), codes.Unauthenticated)
+	}
+}
+
+func TestRoleAllows(t *testing.T) {
+	if !Admin.Allows(Editor) || !Editor.Allows(Viewer) || Viewer.Allows(Editor) || Editor.Allows(Admin) || Role("root").Allows(Viewer) {
+		t.Error("Allows() doesn't follow viewer < editor < admin")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	if _, err := ParseTokens("ci"); err == nil {
+		t.Error("ParseTokens() without token succeeded")
+	}
+	if _, err := ParseUsers("nadir:password"); err == nil {
+		t.Error("ParseUsers() without role succeeded")
+	}
+	if _, err := ParseUsers("nadir:password:root"); err == nil {
+		t.Error("ParseUsers() with unknown role succeeded")
+	}
+}
+
+func TestRSAIssuer(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	publicDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+
+	signer, err := NewRSAIssuer(privateKey, nil, "test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := signer.Issue(Principal{Name: "nadir", Role: Editor})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a server with the public key only verifies the tokens
+	verifier, err := NewRSAIssuer(nil, publicKey, "test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal, err := verifier.Verify(token); err != nil || principal != (Principal{"nadir", Editor}) {
+		t.Errorf("Verify() = %+v, %v, want nadir editor", principal, err)
+	}
+	if _, _, err := verifier.Issue(Principal{Name: "nadir", Role: Editor}); err == nil {
+		t.Error("Issue() without private key succeeded")
+	}
+
+	// a token signed with the HMAC algorithm and the public key is rejected
+	hmac, err := NewHMACIssuer(publicKey, "test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, _, err := hmac.Issue(Principal{Name: "nadir", Role: Admin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(forged); err == nil {
+		t.Error("Verify() accepted a token of another algorithm")
+	}
+}
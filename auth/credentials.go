@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+)
+
+// BasicCredentials sends the user name and password with every request, it implements
+// credentials.PerRPCCredentials
+type BasicCredentials struct {
+	Username string
+	Password string
+	// AllowInsecure allows sending the credentials over connections without TLS
+	AllowInsecure bool
+}
+
+// GetRequestMetadata returns the authorization metadata of the credentials
+func (c BasicCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password))
+	return map[string]string{authorizationKey: "Basic " + encoded}, nil
+}
+
+// RequireTransportSecurity reports whether the credentials require TLS
+func (c BasicCredentials) RequireTransportSecurity() bool {
+	return !c.AllowInsecure
+}
+
+// TokenCredentials sends the bearer token with every request, it implements
+// credentials.PerRPCCredentials
+type TokenCredentials struct {
+	Token string
+	// AllowInsecure allows sending the token over connections without TLS
+	AllowInsecure bool
+}
+
+// GetRequestMetadata returns the authorization metadata of the token
+func (c TokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{authorizationKey: "Bearer " + c.Token}, nil
+}
+
+// RequireTransportSecurity reports whether the token requires TLS
+func (c TokenCredentials) RequireTransportSecurity() bool {
+	return !c.AllowInsecure
+}
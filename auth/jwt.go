@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// minSecretLength is the minimum length of an HMAC secret, as long as the SHA-256 output
+const minSecretLength = 32
+
+// claims represents the claims of the issued tokens, the subject is the user name
+type claims struct {
+	Role Role `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// Issuer signs and verifies JSON Web Tokens
+type Issuer struct {
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+	// name is the iss claim of the tokens
+	name string
+	ttl  time.Duration
+}
+
+// NewHMACIssuer returns issuer of HS256 tokens signed with the secret, valid for ttl
+func NewHMACIssuer(secret []byte, name string, ttl time.Duration) (*Issuer, error) {
+	if len(secret) < minSecretLength {
+		return nil, fmt.Errorf("secret must have at least %d bytes", minSecretLength)
+	}
+	return &Issuer{method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret, name: name, ttl: ttl}, nil
+}
+
+// NewRSAIssuer returns issuer of RS256 tokens valid for ttl. The tokens are signed with the
+// PEM encoded private key and verified with the PEM encoded public key, a nil private key
+// only verifies tokens and a nil public key is derived from the private key
+func NewRSAIssuer(privateKey, publicKey []byte, name string, ttl time.Duration) (*Issuer, error) {
+	issuer := &Issuer{method: jwt.SigningMethodRS256, name: name, ttl: ttl}
+	if privateKey != nil {
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		issuer.signKey, issuer.verifyKey = key, &key.PublicKey
+	}
+	if publicKey != nil {
+		key, err := jwt.ParseRSAPublicKeyFromPEM(publicKey)
+		if err != nil {
+			return nil, err
+		}
+		issuer.verifyKey = key
+	}
+	if issuer.verifyKey == nil {
+		return nil, errors.New("private or public key is required")
+	}
+	return issuer, nil
+}
+
+// Issue returns a signed token of the principal and its expiration time
+func (i *Issuer) Issue(principal Principal) (string, time.Time, error) {
+	if i.signKey == nil {
+		return "", time.Time{}, errors.New("issuer has no signing key")
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(i.ttl)
+	token := jwt.NewWithClaims(i.method, claims{
+		Role: principal.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    i.name,
+			Subject:   principal.Name,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+	signed, err := token.SignedString(i.signKey)
+	return signed, expiresAt, err
+}
+
+// Verify returns the principal of the token when it is signed by the issuer and not expired
+func (i *Issuer) Verify(token string) (Principal, error) {
+	c := &claims{}
+	_, err := jwt.ParseWithClaims(token, c, func(*jwt.Token) (interface{}, error) {
+		return i.verifyKey, nil
+	}, jwt.WithValidMethods([]string{i.method.Alg()}))
+	if err != nil {
+		return Principal{}, err
+	}
+	// expiration is checked by the parser when it is set, a token must always have one
+	if c.ExpiresAt == nil || !c.VerifyIssuer(i.name, true) || c.Subject == "" {
+		return Principal{}, errors.New("token is missing required claims")
+	}
+	if _, err := ParseRole(string(c.Role)); err != nil {
+		return Principal{}, err
+	}
+	return Principal{Name: c.Subject, Role: c.Role}, nil
+}
@@ -0,0 +1,34 @@
+package auth
+
+import "fmt"
+
+// Role represents the permissions of a caller, every role has the permissions of the roles
+// below it
+type Role string
+
+const (
+	// Viewer can read the products
+	Viewer Role = "viewer"
+	// Editor can also create and change the products
+	Editor Role = "editor"
+	// Admin can also delete the products and import them in batches
+	Admin Role = "admin"
+)
+
+// roleRanks orders the roles from the least to the most permissions
+var roleRanks = map[Role]int{Viewer: 1, Editor: 2, Admin: 3}
+
+// ParseRole returns the role with the given name
+func ParseRole(name string) (Role, error) {
+	role := Role(name)
+	if _, ok := roleRanks[role]; !ok {
+		return "", fmt.Errorf("unknown role %q, expected viewer, editor or admin", name)
+	}
+	return role, nil
+}
+
+// Allows reports whether the role has the permissions of the required role
+func (r Role) Allows(required Role) bool {
+	rank, ok := roleRanks[r]
+	return ok && rank >= roleRanks[required]
+}
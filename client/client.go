@@ -5,15 +5,23 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"time"
 
+	"github.com/nadirbasalamah/go-simple-grpc/auth"
+	"github.com/nadirbasalamah/go-simple-grpc/config"
 	"github.com/nadirbasalamah/go-simple-grpc/product/productpb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
 func main() {
 	fmt.Println("Client of product service")
 	// create client server
-	cc, err := grpc.Dial("localhost:50051", grpc.WithInsecure())
+	// every request is authenticated with the user of the .env file
+	credentials := login(config.Config("USERNAME"), config.Config("PASSWORD"))
+	cc, err := grpc.Dial("localhost:50051", grpc.WithInsecure(), grpc.WithPerRPCCredentials(credentials))
 	if err != nil {
 		log.Fatalf("Could not connect to product service: %v\n", err)
 	}
@@ -22,26 +30,73 @@ func main() {
 
 	c := productpb.NewProductServiceClient(cc)
 
+	// print the product changes made below
+	stopWatching := watchProducts(c)
+	defer stopWatching()
+
 	// create a product
-	createProduct(c)
+	productID := createProduct(c)
 
 	// get product by id
-	getProductByID(c)
+	getProductByID(c, productID)
 
 	// update a product
-	updateProduct(c)
+	updateProduct(c, productID)
+
+	// revert the update of the product
+	revertProduct(c, productID)
 
 	// delete a product
-	deleteProduct(c)
+	deleteProduct(c, productID)
+
+	// list the changes of the product
+	listProductHistory(c, productID)
 
 	// get all products
 	getAllProducts(c)
 
 	// create batch product (insert multiple products)
 	createBatchProduct(c)
+
+	// list products page by page
+	listProducts(c)
+
+	// create or update products while streaming
+	upsertProducts(c)
+
+	// create or update a product by name
+	upsertProductByName(c)
+
+	// search products by keywords
+	searchProducts(c)
 }
 
-func createProduct(c productpb.ProductServiceClient) {
+// login returns the credentials of the user, a token issued by Login or the basic credentials
+// when the server doesn't issue tokens. The local connection doesn't use TLS
+func login(username, password string) credentials.PerRPCCredentials {
+	cc, err := grpc.Dial("localhost:50051", grpc.WithInsecure())
+	if err != nil {
+		log.Fatalf("Could not connect to product service: %v\n", err)
+	}
+	defer cc.Close()
+
+	res, err := productpb.NewProductServiceClient(cc).Login(context.Background(), &productpb.LoginRequest{
+		Username: username,
+		Password: password,
+	})
+	if status.Code(err) == codes.Unimplemented {
+		fmt.Println("Login is disabled, using basic credentials")
+		return auth.BasicCredentials{Username: username, Password: password, AllowInsecure: true}
+	}
+	if err != nil {
+		log.Fatalf("Login failed: %v\n", err)
+	}
+
+	fmt.Printf("Logged in as %s until %v\n", res.GetRole(), res.GetExpiresAt().AsTime())
+	return auth.TokenCredentials{Token: res.GetAccessToken(), AllowInsecure: true}
+}
+
+func createProduct(c productpb.ProductServiceClient) int32 {
 	fmt.Println("Create a product")
 	req := &productpb.CreateProductRequest{
 		Product: &productpb.Product{
@@ -50,6 +105,8 @@ func createProduct(c productpb.ProductServiceClient) {
 			Amount:      int32(100),
 			Description: "A sample product",
 		},
+		// a retry with the same key returns the product created by the first request
+		IdempotencyKey: fmt.Sprintf("create-sample-product-%d", time.Now().UnixNano()),
 	}
 
 	res, err := c.CreateProduct(context.Background(), req)
@@ -58,12 +115,19 @@ func createProduct(c productpb.ProductServiceClient) {
 	}
 
 	fmt.Printf("Product created: %v\n", res)
+
+	retried, err := c.CreateProduct(context.Background(), req)
+	if err != nil {
+		log.Fatalf("Unexpected error: %v\n", err)
+	}
+	fmt.Printf("Retried create returned the same product: %v\n", retried.GetProduct().GetId() == res.GetProduct().GetId())
+	return res.GetProduct().GetId()
 }
 
-func getProductByID(c productpb.ProductServiceClient) {
+func getProductByID(c productpb.ProductServiceClient, id int32) {
 	fmt.Println("Get product data by ID")
 	res, err := c.GetProduct(context.Background(), &productpb.GetProductRequest{
-		ProductId: int32(19),
+		ProductId: id,
 	})
 
 	if err != nil {
@@ -73,11 +137,11 @@ func getProductByID(c productpb.ProductServiceClient) {
 	fmt.Printf("Product data: %v\n", res)
 }
 
-func updateProduct(c productpb.ProductServiceClient) {
+func updateProduct(c productpb.ProductServiceClient, id int32) {
 	fmt.Println("Update a product")
 	req := &productpb.EditProductRequest{
 		Product: &productpb.Product{
-			Id:          int32(9),
+			Id:          id,
 			Name:        "Sample Edited product",
 			Category:    "Books",
 			Amount:      int32(100),
@@ -93,10 +157,31 @@ func updateProduct(c productpb.ProductServiceClient) {
 	fmt.Printf("Product updated: %v\n", res)
 }
 
-func deleteProduct(c productpb.ProductServiceClient) {
+func revertProduct(c productpb.ProductServiceClient, id int32) {
+	fmt.Println("Revert a product")
+	old, err := c.GetProduct(context.Background(), &productpb.GetProductRequest{
+		ProductId: id,
+		AsOf:      &productpb.GetProductRequest_AsOfVersion{AsOfVersion: 1},
+	})
+	if err != nil {
+		log.Fatalf("Unexpected error: %v\n", err)
+	}
+	fmt.Printf("Product at version 1: %v\n", old)
+
+	res, err := c.RevertProduct(context.Background(), &productpb.RevertProductRequest{
+		ProductId: id,
+		Version:   1,
+	})
+	if err != nil {
+		log.Fatalf("Unexpected error: %v\n", err)
+	}
+	fmt.Printf("Product reverted: %v\n", res)
+}
+
+func deleteProduct(c productpb.ProductServiceClient, id int32) {
 	fmt.Println("Delete a product")
 	res, err := c.DeleteProduct(context.Background(), &productpb.DeleteProductRequest{
-		ProductId: int32(26),
+		ProductId: id,
 	})
 
 	if err != nil {
@@ -106,6 +191,23 @@ func deleteProduct(c productpb.ProductServiceClient) {
 	fmt.Printf("Product deleted: %v\n", res)
 }
 
+func listProductHistory(c productpb.ProductServiceClient, id int32) {
+	fmt.Println("List product history")
+	res, err := c.ListProductHistory(context.Background(), &productpb.ListProductHistoryRequest{
+		ProductId: id,
+	})
+	if err != nil {
+		log.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	for _, entry := range res.GetEntries() {
+		fmt.Printf("%s by %q from %s at %v\n", entry.GetAction(), entry.GetActor(), entry.GetPeer(), entry.GetTime().AsTime())
+		for _, change := range entry.GetChanges() {
+			fmt.Printf("  %s: %q -> %q\n", change.GetField(), change.GetBefore(), change.GetAfter())
+		}
+	}
+}
+
 func getAllProducts(c productpb.ProductServiceClient) {
 	fmt.Println("All products data")
 	stream, err := c.GetProducts(context.Background(), &productpb.GetProductsRequest{})
@@ -123,6 +225,7 @@ func getAllProducts(c productpb.ProductServiceClient) {
 		}
 		fmt.Println(res.GetProduct())
 	}
+	fmt.Printf("Total products: %v\n", stream.Trailer().Get("total-count"))
 }
 
 func createBatchProduct(c productpb.ProductServiceClient) {
@@ -169,3 +272,144 @@ func createBatchProduct(c productpb.ProductServiceClient) {
 	}
 	fmt.Printf("Create batch product result: %v\n", res)
 }
+
+func listProducts(c productpb.ProductServiceClient) {
+	fmt.Println("List products page by page")
+	req := &productpb.ListProductsRequest{
+		PageSize:   2,
+		SortBy:     productpb.SortField_SORT_FIELD_AMOUNT,
+		Descending: true,
+	}
+
+	for page := 1; ; page++ {
+		res, err := c.ListProducts(context.Background(), req)
+		if err != nil {
+			log.Fatalf("Unexpected error: %v\n", err)
+		}
+
+		fmt.Printf("Page %d of %d products: %v\n", page, res.GetTotalCount(), res.GetProducts())
+		if res.GetNextPageToken() == "" {
+			break
+		}
+		req.PageToken = res.GetNextPageToken()
+	}
+}
+
+func upsertProducts(c productpb.ProductServiceClient) {
+	fmt.Println("Upsert products")
+	requests := []*productpb.UpsertProductsRequest{
+		&productpb.UpsertProductsRequest{
+			CorrelationId: "upsert-1",
+			Product: &productpb.Product{
+				Name:        "Sample upserted product",
+				Category:    "Gadget",
+				Amount:      int32(10),
+				Description: "A sample upserted product",
+			},
+		},
+		&productpb.UpsertProductsRequest{
+			CorrelationId: "upsert-2",
+			Product: &productpb.Product{
+				Id:          int32(-1),
+				Name:        "Missing product",
+				Category:    "Books",
+				Amount:      int32(10),
+				Description: "A product that doesn't exist",
+			},
+		},
+	}
+
+	stream, err := c.UpsertProducts(context.Background())
+	if err != nil {
+		log.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	go func() {
+		for _, req := range requests {
+			fmt.Printf("Sending request: %v\n", req)
+			stream.Send(req)
+		}
+		stream.CloseSend()
+	}()
+
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Error when streaming: %v\n", err)
+		}
+		fmt.Printf("Upsert result: %v\n", res)
+	}
+}
+
+func upsertProductByName(c productpb.ProductServiceClient) {
+	fmt.Println("Upsert a product by name")
+	req := &productpb.UpsertProductRequest{
+		Product: &productpb.Product{
+			Name:        "Sample synced product",
+			Category:    "Gadget",
+			Amount:      int32(30),
+			Description: "A product kept in sync by name",
+		},
+	}
+
+	res, err := c.UpsertProduct(context.Background(), req)
+	if err != nil {
+		log.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	fmt.Printf("Product upserted, created: %v, product: %v\n", res.GetCreated(), res.GetProduct())
+}
+
+func searchProducts(c productpb.ProductServiceClient) {
+	fmt.Println("Search products")
+	req := &productpb.SearchProductsRequest{
+		Query:    "sample product",
+		PageSize: int32(5),
+	}
+
+	res, err := c.SearchProducts(context.Background(), req)
+	if err != nil {
+		log.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	for _, hit := range res.GetHits() {
+		fmt.Printf("Hit (rank %.2f): %s\n", hit.GetRank(), hit.GetHighlight())
+	}
+	for _, facet := range res.GetFacets() {
+		fmt.Printf("Category %s: %d products\n", facet.GetCategory(), facet.GetCount())
+	}
+}
+
+// watchProducts prints the product events in the background until the returned function is called
+func watchProducts(c productpb.ProductServiceClient) func() {
+	fmt.Println("Watch products")
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := c.WatchProducts(ctx, &productpb.WatchProductsRequest{})
+	if err != nil {
+		log.Fatalf("Unexpected error: %v\n", err)
+	}
+	// wait for the header so no change made after this function returns is missed
+	if _, err := stream.Header(); err != nil {
+		log.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			event, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			fmt.Printf("Event %d: %v %s\n", event.GetRevision(), event.GetType(), event.GetProduct().GetName())
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
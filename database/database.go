@@ -1,20 +1,21 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"strconv"
 
 	"github.com/nadirbasalamah/go-simple-grpc/config"
+	"github.com/nadirbasalamah/go-simple-grpc/migration"
 )
 
 // DB represents database
 var DB *sql.DB
 
-// Connect func to connect to the database, if failed returns error
-func Connect() error {
-	var err error
+// DSN returns the connection string of the configured PostgreSQL database
+func DSN() string {
 	p := config.Config("DB_PORT")
 
 	port, err := strconv.ParseUint(p, 10, 32)
@@ -22,24 +23,58 @@ func Connect() error {
 		log.Fatalf("Error parsing string to int\n")
 	}
 
-	DB, err = sql.Open("postgres", fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", config.Config("DB_HOST"), port, config.Config("DB_USER"), config.Config("DB_PASSWORD"), config.Config("DB_NAME")))
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", config.Config("DB_HOST"), port, config.Config("DB_USER"), config.Config("DB_PASSWORD"), config.Config("DB_NAME"))
+}
+
+// Open func to open the database without touching its schema, if failed returns error
+func Open() error {
+	var err error
+	DB, err = sql.Open("postgres", DSN())
 	if err != nil {
 		return err
 	}
 
-	if err = DB.Ping(); err != nil {
+	return DB.Ping()
+}
+
+// Connect func to connect to the database and prepare its schema, if failed returns error
+func Connect() error {
+	if err := Open(); err != nil {
 		return err
 	}
 
-	DB.Query(`CREATE TABLE IF NOT EXISTS products (
-		id SERIAL PRIMARY KEY,
-		amount integer,
-		name text UNIQUE,
-		description text,
-		category text NOT NULL
-	)
-	`)
+	if err := prepareSchema("postgres"); err != nil {
+		return err
+	}
 
 	fmt.Println("Connected to the database")
 	return nil
 }
+
+// prepareSchema refuses schema versions unknown to this binary and applies the pending
+// migrations, unless AUTO_MIGRATE is set to false
+func prepareSchema(dialect string) error {
+	ctx := context.Background()
+	m, err := migration.New(DB, dialect)
+	if err != nil {
+		return err
+	}
+
+	// Up checks the version itself once it holds the migration lock
+	if config.Config("AUTO_MIGRATE") != "false" {
+		return m.Up(ctx)
+	}
+
+	if err := m.Check(ctx); err != nil {
+		return err
+	}
+
+	version, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if version != m.Latest() {
+		return fmt.Errorf("schema version %d is outdated, run migrate up to reach version %d", version, m.Latest())
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/nadirbasalamah/go-simple-grpc/config"
+)
+
+// OpenSQLite func to open the SQLite database file set in SQLITE_PATH without touching its schema,
+// if failed returns error
+func OpenSQLite() error {
+	var err error
+	path := config.Config("SQLITE_PATH")
+	if path == "" {
+		path = "products.db"
+	}
+
+	DB, err = sql.Open("sqlite3", fmt.Sprintf("%s?_busy_timeout=5000", path))
+	if err != nil {
+		return err
+	}
+
+	// SQLite only allows a single writer at a time
+	DB.SetMaxOpenConns(1)
+
+	return DB.Ping()
+}
+
+// ConnectSQLite func to open the SQLite database and prepare its schema, if failed returns error
+func ConnectSQLite() error {
+	if err := OpenSQLite(); err != nil {
+		return err
+	}
+
+	if err := prepareSchema("sqlite"); err != nil {
+		return err
+	}
+
+	fmt.Println("Connected to the SQLite database")
+	return nil
+}
@@ -0,0 +1,245 @@
+package events
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nadirbasalamah/go-simple-grpc/model"
+)
+
+var (
+	// ErrRevisionCompacted is returned when resuming from a revision whose following events
+	// are no longer kept in the history
+	ErrRevisionCompacted = errors.New("revision is older than the kept history")
+	// ErrFutureRevision is returned when resuming from a revision that wasn't published yet
+	ErrFutureRevision = errors.New("revision was not published yet")
+	// ErrSlowSubscriber is reported by a subscription that was closed because it didn't
+	// receive its events fast enough
+	ErrSlowSubscriber = errors.New("subscriber is too slow")
+	// ErrEventsLost is reported by the subscriptions closed because the feed may have
+	// missed events, they can't be resumed
+	ErrEventsLost = errors.New("events were lost")
+	// ErrClosed is reported by the subscriptions of a closed feed
+	ErrClosed = errors.New("feed is closed")
+)
+
+// Feed represents the stream of product events, the service publishes its writes to it
+// and watchers subscribe to it
+type Feed interface {
+	// Publish sends an event of the product change to the subscribers
+	Publish(eventType Type, product model.Product)
+	// AssignsRevisions reports whether Publish assigns the revisions, the changes must then
+	// be published in the order they were written
+	AssignsRevisions() bool
+	// Subscribe returns subscription to the events accepted by filter, a nil filter accepts
+	// every event. The events that followed the event with afterRevision are delivered first
+	// when it is set, otherwise only the events published from now on. The returned revision
+	// is the latest one when subscribing, every later event is delivered to the subscription
+	Subscribe(afterRevision int64, filter func(Event) bool) (*Subscription, int64, error)
+	// Revision returns the revision of the latest event
+	Revision() int64
+	// Close closes every subscription
+	Close() error
+}
+
+// Type represents the kind of change of a product
+type Type int
+
+const (
+	// Created is published when a product is created
+	Created Type = iota + 1
+	// Updated is published when a product is changed or restored
+	Updated
+	// Deleted is published when a product is soft deleted
+	Deleted
+)
+
+// Event represents a change of a product
+type Event struct {
+	// Revision identifies the event, it grows with every event although the events of
+	// concurrent database writes may arrive out of order
+	Revision int64
+	Type     Type
+	// Product is the product after the change
+	Product model.Product
+	Time    time.Time
+}
+
+// Broker publishes the product events to the subscribers and keeps the latest events so
+// subscribers can resume after a revision, it is safe for concurrent use. Revisions are
+// assigned by the broker unless the events come from another source, in which case they
+// may arrive out of order and resuming relies on the order of arrival
+type Broker struct {
+	mu sync.Mutex
+	// revision is the revision of the latest event, maxRevision the highest one
+	revision    int64
+	maxRevision int64
+	history     []Event
+	historySize int
+	bufferSize  int
+	subscribers map[*Subscription]bool
+}
+
+// NewBroker returns broker that keeps the latest historySize events, a subscriber is dropped
+// when bufferSize events are waiting for it
+func NewBroker(historySize int, bufferSize int) *Broker {
+	return &Broker{
+		historySize: historySize,
+		bufferSize:  bufferSize,
+		subscribers: map[*Subscription]bool{},
+	}
+}
+
+// Revision returns the revision of the latest published event
+func (b *Broker) Revision() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.revision
+}
+
+// AssignsRevisions reports true, Publish gives every event the next revision
+func (b *Broker) AssignsRevisions() bool {
+	return true
+}
+
+// Publish sends an event of the product change with the next revision to the subscribers
+func (b *Broker) Publish(eventType Type, product model.Product) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.publish(Event{Revision: b.maxRevision + 1, Type: eventType, Product: product, Time: time.Now()})
+}
+
+// publish sends the event with its own revision to the subscribers, the broker must be locked
+func (b *Broker) publish(event Event) {
+	b.revision = event.Revision
+	if event.Revision > b.maxRevision {
+		b.maxRevision = event.Revision
+	}
+
+	b.history = append(b.history, event)
+	if len(b.history) > b.historySize {
+		b.history = b.history[len(b.history)-b.historySize:]
+	}
+
+	for sub := range b.subscribers {
+		if !sub.filter(event) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			b.drop(sub, ErrSlowSubscriber)
+		}
+	}
+}
+
+// reset closes every subscription with err and forgets the history, revision becomes the
+// latest one
+func (b *Broker) reset(revision int64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscribers {
+		b.drop(sub, err)
+	}
+	b.history = nil
+	b.revision = revision
+	if revision > b.maxRevision {
+		b.maxRevision = revision
+	}
+}
+
+// Close closes every subscription with ErrClosed
+func (b *Broker) Close() error {
+	b.reset(b.Revision(), ErrClosed)
+	return nil
+}
+
+// Subscribe returns subscription to the events accepted by filter, a nil filter accepts every
+// event. The events that followed the event with afterRevision are delivered first when it
+// is set, the event must still be in the history. Otherwise only the events published from
+// now on are delivered. The latest revision is returned with the subscription
+func (b *Broker) Subscribe(afterRevision int64, filter func(Event) bool) (*Subscription, int64, error) {
+	if filter == nil {
+		filter = func(Event) bool { return true }
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	backlog := []Event{}
+	if afterRevision > 0 && afterRevision != b.revision {
+		start := -1
+		for i, event := range b.history {
+			if event.Revision == afterRevision {
+				start = i + 1
+			}
+		}
+		switch {
+		case start < 0 && afterRevision > b.maxRevision:
+			return nil, 0, ErrFutureRevision
+		case start < 0:
+			return nil, 0, ErrRevisionCompacted
+		}
+		for _, event := range b.history[start:] {
+			if filter(event) {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+
+	sub := &Subscription{
+		broker: b,
+		filter: filter,
+		events: make(chan Event, len(backlog)+b.bufferSize),
+	}
+	for _, event := range backlog {
+		sub.events <- event
+	}
+	b.subscribers[sub] = true
+	return sub, b.revision, nil
+}
+
+// drop removes the subscriber and closes its events with err, the broker must be locked
+func (b *Broker) drop(sub *Subscription, err error) {
+	if !b.subscribers[sub] {
+		return
+	}
+	delete(b.subscribers, sub)
+	sub.err = err
+	close(sub.events)
+}
+
+// Subscription represents a subscriber of the broker
+type Subscription struct {
+	broker *Broker
+	filter func(Event) bool
+	events chan Event
+	err    error
+}
+
+// Events returns the channel of the events, it is closed when the subscription is closed
+// or dropped
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Err returns the reason the broker dropped the subscription, it must only be called after
+// the events channel is closed
+func (s *Subscription) Err() error {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+
+	return s.err
+}
+
+// Close stops the delivery of events
+func (s *Subscription) Close() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+
+	s.broker.drop(s, nil)
+}
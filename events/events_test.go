@@ -0,0 +1,71 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/nadirbasalamah/go-simple-grpc/model"
+)
+
+func TestBrokerResume(t *testing.T) {
+	b := NewBroker(3, 10)
+	for _, category := range []string{"Gadget", "Books", "Gadget"} {
+		b.Publish(Created, model.Product{Category: category})
+	}
+
+	sub, revision, err := b.Subscribe(1, func(event Event) bool { return event.Product.Category == "Gadget" })
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	defer sub.Close()
+	if revision != 3 {
+		t.Errorf("Subscribe() revision = %d, want 3", revision)
+	}
+
+	b.Publish(Updated, model.Product{Category: "Books"})
+	b.Publish(Deleted, model.Product{Category: "Gadget"})
+	for _, want := range []int64{3, 5} {
+		if event := <-sub.Events(); event.Revision != want {
+			t.Errorf("Events() revision = %d, want %d", event.Revision, want)
+		}
+	}
+
+	if _, _, err := b.Subscribe(1, nil); err != ErrRevisionCompacted {
+		t.Errorf("Subscribe() after compacted revision error = %v, want %v", err, ErrRevisionCompacted)
+	}
+	if _, _, err := b.Subscribe(6, nil); err != ErrFutureRevision {
+		t.Errorf("Subscribe() after future revision error = %v, want %v", err, ErrFutureRevision)
+	}
+}
+
+func TestBrokerSlowSubscriber(t *testing.T) {
+	b := NewBroker(10, 1)
+	sub, _, err := b.Subscribe(0, nil)
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+
+	b.Publish(Created, model.Product{})
+	b.Publish(Created, model.Product{})
+
+	if event := <-sub.Events(); event.Revision != 1 {
+		t.Errorf("Events() revision = %d, want 1", event.Revision)
+	}
+	if _, ok := <-sub.Events(); ok {
+		t.Fatal("Events() is not closed for a slow subscriber")
+	}
+	if sub.Err() != ErrSlowSubscriber {
+		t.Errorf("Err() = %v, want %v", sub.Err(), ErrSlowSubscriber)
+	}
+	sub.Close()
+}
+
+func TestDecodeNotification(t *testing.T) {
+	payload := `{"revision" : 7, "type" : "deleted", "product" : {"id":3,"amount":10,"name":"Lamp","description":"A lamp","category":"Gadget","version":2,"deleted_at":"2020-11-02T10:04:05.123456+00:00"}, "time" : "2020-11-02T10:04:05.123456+00:00"}`
+	event, err := decodeNotification(payload)
+	if err != nil {
+		t.Fatalf("decodeNotification() error = %v", err)
+	}
+	if event.Revision != 7 || event.Type != Deleted || event.Product.ID != 3 || event.Product.Version != 2 || event.Product.DeletedAt == nil {
+		t.Errorf("decodeNotification() = %+v", event)
+	}
+}
@@ -0,0 +1,153 @@
+package events
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nadirbasalamah/go-simple-grpc/model"
+)
+
+// productChannel is the notification channel of the products table trigger
+const productChannel = "product_changes"
+
+// pingInterval is how long the listener waits for a notification before checking the connection
+const pingInterval = 90 * time.Second
+
+// PostgresFeed represents the feed of the product changes notified by the PostgreSQL
+// trigger of the products table, so every server sees the writes of the others
+type PostgresFeed struct {
+	db       *sql.DB
+	broker   *Broker
+	listener *pq.Listener
+	done     chan struct{}
+}
+
+// productNotification represents the payload of the trigger notifications
+type productNotification struct {
+	Revision int64         `json:"revision"`
+	Type     string        `json:"type"`
+	Product  model.Product `json:"product"`
+	Time     time.Time     `json:"time"`
+}
+
+// NewPostgresFeed returns feed that listens to the notifications of the database with the
+// connection string and fans them out through the broker, the db is used to read the latest
+// revision
+func NewPostgresFeed(db *sql.DB, connInfo string, broker *Broker) (*PostgresFeed, error) {
+	f := &PostgresFeed{db: db, broker: broker, done: make(chan struct{})}
+	f.listener = pq.NewListener(connInfo, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventDisconnected:
+			log.Printf("Product change listener disconnected: %v\n", err)
+		case pq.ListenerEventConnectionAttemptFailed:
+			log.Printf("Product change listener failed to reconnect: %v\n", err)
+		case pq.ListenerEventReconnected:
+			log.Println("Product change listener reconnected")
+		}
+	})
+	if err := f.listener.Listen(productChannel); err != nil {
+		f.listener.Close()
+		return nil, err
+	}
+
+	// the revision is read once listening so no later event is missed
+	if err := f.resync(nil); err != nil {
+		f.listener.Close()
+		return nil, err
+	}
+
+	go f.run()
+	return f, nil
+}
+
+// Publish does nothing, the trigger of the products table notifies every write
+func (f *PostgresFeed) Publish(eventType Type, product model.Product) {}
+
+// AssignsRevisions reports false, the revisions come from the sequence of the trigger
+func (f *PostgresFeed) AssignsRevisions() bool {
+	return false
+}
+
+// Subscribe returns subscription to the notified events accepted by filter
+func (f *PostgresFeed) Subscribe(afterRevision int64, filter func(Event) bool) (*Subscription, int64, error) {
+	return f.broker.Subscribe(afterRevision, filter)
+}
+
+// Revision returns the revision of the latest notified event
+func (f *PostgresFeed) Revision() int64 {
+	return f.broker.Revision()
+}
+
+// Close stops listening and closes every subscription
+func (f *PostgresFeed) Close() error {
+	err := f.listener.Close()
+	<-f.done
+	f.broker.Close()
+	return err
+}
+
+func (f *PostgresFeed) run() {
+	defer close(f.done)
+	for {
+		select {
+		case n, ok := <-f.listener.Notify:
+			if !ok {
+				return
+			}
+			if n == nil {
+				// notifications sent while reconnecting are lost, the watchers must start over
+				if err := f.resync(ErrEventsLost); err != nil {
+					log.Printf("Read product change revision failed: %v\n", err)
+				}
+				continue
+			}
+
+			event, err := decodeNotification(n.Extra)
+			if err != nil {
+				log.Printf("Invalid product change notification %q: %v\n", n.Extra, err)
+				continue
+			}
+			f.broker.mu.Lock()
+			f.broker.publish(event)
+			f.broker.mu.Unlock()
+		case <-time.After(pingInterval):
+			// a dead connection is only noticed when something is sent
+			go f.listener.Ping()
+		}
+	}
+}
+
+// resync resets the broker to the latest revision of the database, closing the
+// subscriptions with reason
+func (f *PostgresFeed) resync(reason error) error {
+	var revision int64
+	var called bool
+	err := f.db.QueryRow("SELECT last_value, is_called FROM product_change_revision").Scan(&revision, &called)
+	switch {
+	case err != nil:
+		revision = f.broker.Revision()
+	case !called:
+		// the sequence wasn't used yet, last_value is its start value
+		revision = 0
+	}
+	f.broker.reset(revision, reason)
+	return err
+}
+
+func decodeNotification(payload string) (Event, error) {
+	n := productNotification{}
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		return Event{}, err
+	}
+
+	eventTypes := map[string]Type{"created": Created, "updated": Updated, "deleted": Deleted}
+	return Event{
+		Revision: n.Revision,
+		Type:     eventTypes[n.Type],
+		Product:  n.Product,
+		Time:     n.Time,
+	}, nil
+}
@@ -1,14 +1,16 @@
 module github.com/nadirbasalamah/go-simple-grpc
 
-go 1.15
+go 1.16
 
 require (
+	github.com/golang-jwt/jwt/v4 v4.5.2
 	github.com/golang/protobuf v1.4.3
 	github.com/joho/godotenv v1.3.0
 	github.com/lib/pq v1.8.0
+	github.com/mattn/go-sqlite3 v1.14.16
 	golang.org/x/lint v0.0.0-20200302205851-738671d3881b // indirect
 	golang.org/x/tools v0.0.0-20201105220310-78b158585360 // indirect
-	google.golang.org/genproto v0.0.0-20201105153401-9d023cd09d72 // indirect
+	google.golang.org/genproto v0.0.0-20201105153401-9d023cd09d72
 	google.golang.org/grpc v1.27.0
 	google.golang.org/protobuf v1.25.0
 )
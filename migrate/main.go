@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nadirbasalamah/go-simple-grpc/config"
+	"github.com/nadirbasalamah/go-simple-grpc/database"
+	"github.com/nadirbasalamah/go-simple-grpc/migration"
+)
+
+const usage = `Usage: migrate <command>
+
+Commands:
+  up            apply all pending migrations
+  down          revert the latest applied migration
+  status        show the state of every migration
+  to <version>  migrate up or down to the given version`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+
+	m, err := newMigrator()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	switch os.Args[1] {
+	case "up":
+		err = m.Up(ctx)
+	case "down":
+		err = m.Down(ctx)
+	case "status":
+		err = printStatus(ctx, m)
+	case "to":
+		if len(os.Args) < 3 {
+			log.Fatalf("Missing target version\n")
+		}
+		version, convErr := strconv.Atoi(os.Args[2])
+		if convErr != nil {
+			log.Fatalf("Invalid version: %s\n", os.Args[2])
+		}
+		err = m.To(ctx, version)
+	default:
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	version, err := m.Version(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Schema version: %d (latest %d)\n", version, m.Latest())
+}
+
+// newMigrator opens the database of the configured STORAGE without preparing its schema
+func newMigrator() (*migration.Migrator, error) {
+	switch storage := config.Config("STORAGE"); storage {
+	case "", "postgres":
+		if err := database.Open(); err != nil {
+			return nil, err
+		}
+		return migration.New(database.DB, "postgres")
+	case "sqlite":
+		if err := database.OpenSQLite(); err != nil {
+			return nil, err
+		}
+		return migration.New(database.DB, "sqlite")
+	default:
+		return nil, fmt.Errorf("storage %s has no schema to migrate", storage)
+	}
+}
+
+func printStatus(ctx context.Context, m *migration.Migrator) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range statuses {
+		state := "pending"
+		if s.Applied {
+			state = "applied at " + s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%04d %-40s %s\n", s.Version, s.Name, state)
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package migration
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed postgres/*.sql sqlite/*.sql
+var files embed.FS
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// lockKey is the PostgreSQL advisory lock held while migrating, so the servers starting at
+// the same time migrate one after another
+const lockKey = 4200931
+
+// ErrUnknownVersion is returned when the database contains a schema version
+// that is not known by this binary
+var ErrUnknownVersion = errors.New("unknown schema version")
+
+// Migration represents a single numbered schema change
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status represents the state of a migration in the database
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator applies the embedded migrations of a dialect to a database
+type Migrator struct {
+	db         *sql.DB
+	dialect    string
+	migrations []Migration
+}
+
+// New returns migrator for the given database, dialect is either postgres or sqlite
+func New(db *sql.DB, dialect string) (*Migrator, error) {
+	migrations, err := load(dialect)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, dialect: dialect, migrations: migrations}, nil
+}
+
+func load(dialect string) ([]Migration, error) {
+	entries, err := fs.ReadDir(files, dialect)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for dialect %s", dialect)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name: %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		content, err := files.ReadFile(path.Join(dialect, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := []Migration{}
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Latest returns the newest schema version known by this binary
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+func (m *Migrator) ensureTable(ctx context.Context) error {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamp NOT NULL
+	)`)
+	return err
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int]time.Time, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := m.db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// Version returns the current schema version of the database, 0 means no migration has been applied
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	version := 0
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// Check returns ErrUnknownVersion if the database has a migration applied that this binary doesn't know
+func (m *Migrator) Check(ctx context.Context) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	known := map[int]bool{}
+	for _, migration := range m.migrations {
+		known[migration.Version] = true
+	}
+	for version := range applied {
+		if !known[version] {
+			return fmt.Errorf("%w %d, this binary supports up to version %d", ErrUnknownVersion, version, m.Latest())
+		}
+	}
+	return nil
+}
+
+// Status returns every known migration with its applied state
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []Status{}
+	for _, migration := range m.migrations {
+		appliedAt, ok := applied[migration.Version]
+		statuses = append(statuses, Status{Migration: migration, Applied: ok, AppliedAt: appliedAt})
+	}
+	return statuses, nil
+}
+
+// Up applies all pending migrations
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.To(ctx, m.Latest())
+}
+
+// Down reverts the latest applied migration
+func (m *Migrator) Down(ctx context.Context) error {
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	version, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		return nil
+	}
+
+	target := 0
+	for _, migration := range m.migrations {
+		if migration.Version < version {
+			target = migration.Version
+		}
+	}
+	return m.to(ctx, target)
+}
+
+// To migrates the database up or down to the given version
+func (m *Migrator) To(ctx context.Context, version int) error {
+	if version != 0 && !m.known(version) {
+		return fmt.Errorf("%w %d", ErrUnknownVersion, version)
+	}
+
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return m.to(ctx, version)
+}
+
+// to migrates the database to the given version, the migration lock must be held so the
+// applied migrations read here stay current
+func (m *Migrator) to(ctx context.Context, version int) error {
+	if err := m.Check(ctx); err != nil {
+		return err
+	}
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; !ok && migration.Version <= version {
+			if err := m.apply(ctx, migration, true); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; ok && migration.Version > version {
+			if err := m.apply(ctx, migration, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lock waits for the migration lock and returns the function releasing it. On PostgreSQL it
+// is an advisory lock held by a dedicated connection, SQLite is used by a single server and
+// runs every migration in a transaction of its only connection
+func (m *Migrator) lock(ctx context.Context) (func(), error) {
+	if m.dialect != "postgres" {
+		return func() {}, nil
+	}
+
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockKey); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("migration lock failed: %w", err)
+	}
+	return func() {
+		// closing the connection releases the lock as well if the unlock fails
+		conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockKey)
+		conn.Close()
+	}, nil
+}
+
+func (m *Migrator) known(version int) bool {
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// apply runs a single migration and records it in the same transaction
+func (m *Migrator) apply(ctx context.Context, migration Migration, up bool) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	script, record := migration.Down, m.bind("DELETE FROM schema_migrations WHERE version = ?")
+	args := []interface{}{migration.Version}
+	if up {
+		script, record = migration.Up, m.bind("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)")
+		args = append(args, migration.Name, time.Now().UTC())
+	}
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// bind converts the ? placeholders into $1, $2, ... for PostgreSQL
+func (m *Migrator) bind(query string) string {
+	if m.dialect != "postgres" {
+		return query
+	}
+	n := 0
+	return regexp.MustCompile(`\?`).ReplaceAllStringFunc(query, func(string) string {
+		n++
+		return "$" + strconv.Itoa(n)
+	})
+}
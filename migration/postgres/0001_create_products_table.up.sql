@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS products (
+	id SERIAL PRIMARY KEY,
+	amount integer,
+	name text UNIQUE,
+	description text,
+	category text NOT NULL
+);
@@ -0,0 +1,5 @@
+CREATE INDEX products_search_idx ON products USING GIN ((
+	setweight(to_tsvector('english', coalesce(name, '')), 'A') ||
+	setweight(to_tsvector('english', coalesce(description, '')), 'B') ||
+	setweight(to_tsvector('english', coalesce(category, '')), 'C')
+));
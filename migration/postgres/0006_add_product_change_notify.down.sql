@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS products_notify_change ON products;
+DROP FUNCTION IF EXISTS notify_product_change();
+DROP SEQUENCE IF EXISTS product_change_revision;
@@ -0,0 +1,24 @@
+CREATE SEQUENCE product_change_revision;
+
+CREATE FUNCTION notify_product_change() RETURNS trigger AS $$
+DECLARE
+	event_type text := 'updated';
+BEGIN
+	IF TG_OP = 'INSERT' THEN
+		event_type := 'created';
+	ELSIF NEW.deleted_at IS NOT NULL AND OLD.deleted_at IS NULL THEN
+		event_type := 'deleted';
+	END IF;
+
+	PERFORM pg_notify('product_changes', json_build_object(
+		'revision', nextval('product_change_revision'),
+		'type', event_type,
+		'product', row_to_json(NEW),
+		'time', now()
+	)::text);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER products_notify_change AFTER INSERT OR UPDATE ON products
+	FOR EACH ROW EXECUTE PROCEDURE notify_product_change();
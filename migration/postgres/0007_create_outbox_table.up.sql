@@ -0,0 +1,11 @@
+CREATE TABLE outbox (
+	id bigserial PRIMARY KEY,
+	payload jsonb NOT NULL,
+	created_at timestamptz NOT NULL,
+	attempts integer NOT NULL DEFAULT 0,
+	next_attempt_at timestamptz NOT NULL,
+	last_error text,
+	delivered_at timestamptz
+);
+
+CREATE INDEX outbox_pending_idx ON outbox (id) WHERE delivered_at IS NULL;
@@ -0,0 +1,26 @@
+CREATE TABLE product_audit (
+	id bigserial PRIMARY KEY,
+	product_id integer NOT NULL,
+	action text NOT NULL,
+	actor text NOT NULL,
+	peer text NOT NULL,
+	changed_at timestamptz NOT NULL,
+	version integer NOT NULL,
+	product jsonb NOT NULL,
+	changes jsonb NOT NULL
+);
+
+CREATE INDEX product_audit_product_id_idx ON product_audit (product_id, id);
+CREATE INDEX product_audit_version_idx ON product_audit (product_id, version);
+
+-- the existing products start their history with their current state, dated at the epoch
+-- since the time they were written is unknown
+INSERT INTO product_audit (product_id, action, actor, peer, changed_at, version, product, changes)
+SELECT id, 'baseline', '', '', '1970-01-01 00:00:00+00', version,
+	jsonb_strip_nulls(jsonb_build_object(
+		'id', id, 'name', coalesce(name, ''), 'description', coalesce(description, ''), 'category', category,
+		'amount', coalesce(amount, 0), 'version', version, 'deleted_at', deleted_at
+	)),
+	'[]'
+FROM products
+ORDER BY id;
@@ -0,0 +1,2 @@
+ALTER TABLE outbox ADD COLUMN claim_token text;
+ALTER TABLE outbox ADD COLUMN claimed_until timestamptz;
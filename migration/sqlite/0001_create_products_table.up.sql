@@ -0,0 +1,8 @@
+-- AUTOINCREMENT never reuses the id of deleted rows, just like SERIAL
+CREATE TABLE IF NOT EXISTS products (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	amount integer,
+	name text UNIQUE,
+	description text,
+	category text NOT NULL
+);
@@ -0,0 +1,8 @@
+CREATE TABLE idempotency_keys (
+	key text PRIMARY KEY,
+	request_hash text NOT NULL,
+	response blob,
+	expires_at timestamp NOT NULL
+);
+
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
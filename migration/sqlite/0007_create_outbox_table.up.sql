@@ -0,0 +1,11 @@
+CREATE TABLE outbox (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	payload text NOT NULL,
+	created_at timestamp NOT NULL,
+	attempts integer NOT NULL DEFAULT 0,
+	next_attempt_at timestamp NOT NULL,
+	last_error text,
+	delivered_at timestamp
+);
+
+CREATE INDEX outbox_pending_idx ON outbox (id) WHERE delivered_at IS NULL;
@@ -0,0 +1,26 @@
+CREATE TABLE product_audit (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	product_id integer NOT NULL,
+	action text NOT NULL,
+	actor text NOT NULL,
+	peer text NOT NULL,
+	changed_at timestamp NOT NULL,
+	version integer NOT NULL,
+	product text NOT NULL,
+	changes text NOT NULL
+);
+
+CREATE INDEX product_audit_product_id_idx ON product_audit (product_id, id);
+CREATE INDEX product_audit_version_idx ON product_audit (product_id, version);
+
+-- the existing products start their history with their current state, dated at the epoch
+-- since the time they were written is unknown. The stored times only need the T of RFC 3339
+INSERT INTO product_audit (product_id, action, actor, peer, changed_at, version, product, changes)
+SELECT id, 'baseline', '', '', '1970-01-01 00:00:00+00:00', version,
+	json_object(
+		'id', id, 'name', coalesce(name, ''), 'description', coalesce(description, ''), 'category', category,
+		'amount', coalesce(amount, 0), 'version', version, 'deleted_at', replace(deleted_at, ' ', 'T')
+	),
+	'[]'
+FROM products
+ORDER BY id;
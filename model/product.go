@@ -1,12 +1,37 @@
 package model
 
+import "time"
+
 // Product struct represents product model
 type Product struct {
-	ID          int
-	Name        string
-	Description string
-	Category    string
-	Amount      int
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Category    string `json:"category"`
+	Amount      int    `json:"amount"`
+	// Version starts at 1 and is incremented by every update
+	Version int `json:"version"`
+	// DeletedAt is set when the product is soft deleted
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// ProductFields lists the product fields that can be updated
+var ProductFields = []string{"name", "description", "category", "amount"}
+
+// FieldValue returns the value of one of the ProductFields
+func (p Product) FieldValue(field string) interface{} {
+	switch field {
+	case "name":
+		return p.Name
+	case "description":
+		return p.Description
+	case "category":
+		return p.Category
+	case "amount":
+		return p.Amount
+	default:
+		panic("unknown product field " + field)
+	}
 }
 
 // Products struct represents products model
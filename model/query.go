@@ -0,0 +1,48 @@
+package model
+
+// SortField represents the field used to order products
+type SortField int
+
+const (
+	// SortByName orders products by name
+	SortByName SortField = iota
+	// SortByID orders products by id
+	SortByID
+	// SortByAmount orders products by amount
+	SortByAmount
+)
+
+// ProductFilter represents the conditions that listed products must match,
+// zero values are ignored
+type ProductFilter struct {
+	Category   string
+	NamePrefix string
+	MinAmount  *int
+	MaxAmount  *int
+	// ShowDeleted includes the soft deleted products
+	ShowDeleted bool
+}
+
+// ProductQuery represents filtering, sorting and pagination of products listing
+type ProductQuery struct {
+	Filter     ProductFilter
+	SortBy     SortField
+	Descending bool
+	PageSize   int
+	PageToken  string
+}
+
+// SearchQuery represents a keyword search of products with pagination
+type SearchQuery struct {
+	Query     string
+	Category  string
+	PageSize  int
+	PageToken string
+}
+
+// HistoryQuery represents the requested page of the change history of a product
+type HistoryQuery struct {
+	ProductID int
+	PageSize  int
+	PageToken string
+}
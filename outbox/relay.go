@@ -0,0 +1,137 @@
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/nadirbasalamah/go-simple-grpc/repository"
+)
+
+// purgeInterval is the time between the removals of the delivered messages
+const purgeInterval = time.Hour
+
+// Relay delivers the outbox messages to a sink in the order they were written. A message is
+// only marked as delivered after the sink accepted it, so it is delivered at least once. A
+// failed message is retried with an exponential backoff and holds back the following ones.
+// The messages are claimed before their delivery, so the relays of several servers sharing
+// the outbox take turns instead of delivering every message each
+type Relay struct {
+	store repository.OutboxStore
+	sink  Sink
+	// claim identifies the claims of the relay
+	claim string
+	// BatchSize is the number of messages read at once
+	BatchSize int
+	// PollInterval is the time between the reads of the outbox once every message is delivered
+	PollInterval time.Duration
+	// Lease is how long the claimed messages are held, it must exceed the delivery of a batch
+	// since another relay takes the messages over once it ended
+	Lease time.Duration
+	// MinBackoff is the delay of the first retry, it doubles with every failure up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Retention is how long delivered messages are kept, 0 keeps them forever
+	Retention time.Duration
+}
+
+// NewRelay returns relay of the outbox messages of the store to the sink with the default
+// settings
+func NewRelay(store repository.OutboxStore, sink Sink) *Relay {
+	claim := make([]byte, 16)
+	rand.Read(claim)
+	return &Relay{
+		store:        store,
+		sink:         sink,
+		claim:        hex.EncodeToString(claim),
+		BatchSize:    100,
+		PollInterval: time.Second,
+		Lease:        time.Minute,
+		MinBackoff:   time.Second,
+		MaxBackoff:   5 * time.Minute,
+		Retention:    7 * 24 * time.Hour,
+	}
+}
+
+// Run delivers the messages until ctx is done
+func (r *Relay) Run(ctx context.Context) {
+	lastPurge := time.Time{}
+	for {
+		delivered, err := r.Deliver(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Outbox delivery failed: %v\n", err)
+		}
+
+		if r.Retention > 0 && time.Since(lastPurge) >= purgeInterval {
+			lastPurge = time.Now()
+			if _, err := r.store.PurgeDelivered(ctx, lastPurge.Add(-r.Retention)); err != nil && ctx.Err() == nil {
+				log.Printf("Outbox purge failed: %v\n", err)
+			}
+		}
+
+		// a full batch may be followed by more messages
+		wait := r.PollInterval
+		if err == nil && delivered == r.BatchSize {
+			wait = 0
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Deliver claims the pending messages and sends the ones that are due, it returns how many
+// were delivered. It stops at the first message that fails or isn't due yet to keep the
+// order and releases the remaining messages
+func (r *Relay) Deliver(ctx context.Context) (int, error) {
+	messages, err := r.store.ClaimOutbox(ctx, r.claim, r.BatchSize, r.Lease)
+	if err != nil {
+		return 0, err
+	}
+	if len(messages) == 0 {
+		return 0, nil
+	}
+	defer func() {
+		// ctx may be done already, the claim expires with the lease otherwise
+		if err := r.store.ReleaseOutbox(context.Background(), r.claim); err != nil {
+			log.Printf("Outbox release failed: %v\n", err)
+		}
+	}()
+
+	delivered := 0
+	for _, message := range messages {
+		now := time.Now()
+		if message.NextAttemptAt.After(now) {
+			break
+		}
+
+		if err := r.sink.Deliver(ctx, message); err != nil {
+			if ctx.Err() != nil {
+				return delivered, ctx.Err()
+			}
+			log.Printf("Outbox message %d delivery failed, attempt %d: %v\n", message.ID, message.Attempts+1, err)
+			return delivered, r.store.MarkOutboxFailed(ctx, r.claim, message.ID, now.Add(r.backoff(message.Attempts+1)), err.Error())
+		}
+		if err := r.store.MarkOutboxDelivered(ctx, r.claim, message.ID); err != nil {
+			return delivered, err
+		}
+		delivered++
+	}
+	return delivered, nil
+}
+
+// backoff returns the delay before the retry that follows the given number of failures
+func (r *Relay) backoff(failures int) time.Duration {
+	delay := r.MinBackoff
+	for i := 1; i < failures && delay < r.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > r.MaxBackoff {
+		return r.MaxBackoff
+	}
+	return delay
+}
@@ -0,0 +1,125 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nadirbasalamah/go-simple-grpc/model"
+	"github.com/nadirbasalamah/go-simple-grpc/repository"
+)
+
+// flakySink fails the first failures deliveries and records the delivered message ids
+type flakySink struct {
+	failures  int
+	delivered []int64
+}
+
+func (s *flakySink) Deliver(ctx context.Context, message repository.OutboxMessage) error {
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("unreachable")
+	}
+	s.delivered = append(s.delivered, message.ID)
+	return nil
+}
+
+// newTestOutbox returns memory repository with an outbox message for every name
+func newTestOutbox(t *testing.T, names ...string) *repository.MemoryRepository {
+	ctx := context.Background()
+	repo := repository.NewMemoryRepository()
+	for _, name := range names {
+		if _, err := repo.Create(ctx, model.Product{Name: name}); err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+	}
+	return repo
+}
+
+func TestRelayRetriesInOrder(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestOutbox(t, "First product", "Second product")
+	sink := &flakySink{failures: 1}
+	relay := NewRelay(repo, sink)
+	relay.MinBackoff = time.Millisecond
+
+	// the failed message holds back the following one until it is due again
+	if delivered, err := relay.Deliver(ctx); delivered != 0 || err != nil {
+		t.Errorf("Deliver() = %d, %v, want 0, nil", delivered, err)
+	}
+	if delivered, err := relay.Deliver(ctx); delivered != 0 || err != nil {
+		t.Errorf("Deliver() before the backoff = %d, %v, want 0, nil", delivered, err)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	if delivered, err := relay.Deliver(ctx); delivered != 2 || err != nil {
+		t.Errorf("Deliver() after the backoff = %d, %v, want 2, nil", delivered, err)
+	}
+	if want := []int64{1, 2}; !reflect.DeepEqual(sink.delivered, want) {
+		t.Errorf("delivered messages = %v, want %v", sink.delivered, want)
+	}
+
+	pending, err := repo.ClaimOutbox(ctx, "check", 10, time.Minute)
+	if err != nil {
+		t.Fatalf("ClaimOutbox() error = %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("ClaimOutbox() after the deliveries = %+v, want no message", pending)
+	}
+}
+
+func TestRelayClaims(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestOutbox(t, "First product", "Second product")
+	first, second := &flakySink{}, &flakySink{}
+	firstRelay, secondRelay := NewRelay(repo, first), NewRelay(repo, second)
+
+	// the messages held by a relay aren't delivered by the other one
+	claimed, err := repo.ClaimOutbox(ctx, firstRelay.claim, 10, time.Minute)
+	if err != nil {
+		t.Fatalf("ClaimOutbox() error = %v", err)
+	}
+	if len(claimed) != 2 {
+		t.Fatalf("ClaimOutbox() = %+v, want 2 messages", claimed)
+	}
+	if delivered, err := secondRelay.Deliver(ctx); delivered != 0 || err != nil {
+		t.Errorf("Deliver() of claimed messages = %d, %v, want 0, nil", delivered, err)
+	}
+
+	if err := repo.ReleaseOutbox(ctx, firstRelay.claim); err != nil {
+		t.Fatalf("ReleaseOutbox() error = %v", err)
+	}
+	if delivered, err := secondRelay.Deliver(ctx); delivered != 2 || err != nil {
+		t.Errorf("Deliver() of released messages = %d, %v, want 2, nil", delivered, err)
+	}
+	if err := repo.MarkOutboxDelivered(ctx, firstRelay.claim, claimed[0].ID); err != repository.ErrClaimLost {
+		t.Errorf("MarkOutboxDelivered() of released message error = %v, want %v", err, repository.ErrClaimLost)
+	}
+	if delivered, err := firstRelay.Deliver(ctx); delivered != 0 || err != nil {
+		t.Errorf("Deliver() of delivered messages = %d, %v, want 0, nil", delivered, err)
+	}
+	if len(first.delivered) != 0 || len(second.delivered) != 2 {
+		t.Errorf("delivered messages = %v and %v, want none and 2", first.delivered, second.delivered)
+	}
+}
+
+func TestRelayBackoff(t *testing.T) {
+	relay := &Relay{MinBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{60, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := relay.backoff(tt.failures); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
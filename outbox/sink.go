@@ -0,0 +1,120 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nadirbasalamah/go-simple-grpc/repository"
+)
+
+// Sink represents the destination of the outbox messages, a message is delivered again
+// when Deliver fails so sinks must tolerate duplicates
+type Sink interface {
+	Deliver(ctx context.Context, message repository.OutboxMessage) error
+}
+
+// envelope is the delivered form of an outbox message, the id lets receivers drop duplicates
+type envelope struct {
+	ID      int64           `json:"id"`
+	Attempt int             `json:"attempt"`
+	Event   json.RawMessage `json:"event"`
+}
+
+// encode returns the JSON encoded envelope of the message
+func encode(message repository.OutboxMessage) ([]byte, error) {
+	return json.Marshal(envelope{ID: message.ID, Attempt: message.Attempts + 1, Event: message.Payload})
+}
+
+// WriterSink writes every message as a line of JSON, it is safe for concurrent use
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+	// sync flushes the written message when it is set
+	sync func() error
+}
+
+// NewStdoutSink returns sink that writes the messages to the standard output
+func NewStdoutSink() *WriterSink {
+	return &WriterSink{w: os.Stdout}
+}
+
+// NewFileSink returns sink that appends the messages to the file with the given path, every
+// message is flushed to the disk before it is considered delivered
+func NewFileSink(path string) (*WriterSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("outbox file is not set")
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &WriterSink{w: file, sync: file.Sync}, nil
+}
+
+// Deliver writes the message as a line of JSON
+func (s *WriterSink) Deliver(ctx context.Context, message repository.OutboxMessage) error {
+	line, err := encode(message)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if s.sync != nil {
+		return s.sync()
+	}
+	return nil
+}
+
+// WebhookSink posts every message as JSON to an URL, a response status other than 2xx is
+// a failed delivery
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookSink returns sink that posts the messages to the url, a delivery fails when no
+// response is received within timeout
+func NewWebhookSink(url string, timeout time.Duration) *WebhookSink {
+	return &WebhookSink{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+// Deliver posts the message to the webhook
+func (s *WebhookSink) Deliver(ctx context.Context, message repository.OutboxMessage) error {
+	body, err := encode(message)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Outbox-Id", strconv.FormatInt(message.ID, 10))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// the body is drained so the connection is reused
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/nadirbasalamah/go-simple-grpc/model"
+)
+
+// Audit actions
+const (
+	AuditCreated  = "created"
+	AuditUpdated  = "updated"
+	AuditDeleted  = "deleted"
+	AuditRestored = "restored"
+	AuditPurged   = "purged"
+	AuditReverted = "reverted"
+	// AuditBaseline is the first entry of the products that existed before the audit log,
+	// it holds their state when the log was created and lists no change
+	AuditBaseline = "baseline"
+)
+
+// Actor represents the caller that changed a product
+type Actor struct {
+	// Identity is who the caller claims or was authenticated to be, empty when unknown
+	Identity string
+	// Peer is the network address of the caller
+	Peer string
+}
+
+type actorKey struct{}
+
+// WithActor returns a copy of ctx carrying the actor, the changes written with it are
+// attributed to the actor in the audit log
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor carried by ctx, or an empty actor
+func ActorFromContext(ctx context.Context) Actor {
+	actor, _ := ctx.Value(actorKey{}).(Actor)
+	return actor
+}
+
+// FieldChange represents the values of a product field before and after a change
+type FieldChange struct {
+	Field  string `json:"field"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// AuditEntry represents a recorded change of a product
+type AuditEntry struct {
+	ID        int64
+	ProductID int
+	Action    string
+	Actor     Actor
+	Time      time.Time
+	// Product is the product after the change
+	Product model.Product
+	// Changes lists the fields that differ from the previous entry of the product
+	Changes []FieldChange
+}
+
+// HistoryOptions represents a page of the audit log of a product
+type HistoryOptions struct {
+	// Limit is the maximum number of returned entries, 0 means no limit
+	Limit int
+	// BeforeID skips the entries from the one with this id on, 0 starts at the latest entry
+	BeforeID int64
+}
+
+// HistoryResult represents the audit entries of a product, the latest first
+type HistoryResult struct {
+	Entries []AuditEntry
+	// HasMore reports whether older entries follow the returned ones
+	HasMore bool
+}
+
+// AsOf represents a past state of a product, by time or by version
+type AsOf struct {
+	// Time selects the state of the product at the time, when Version is 0
+	Time time.Time
+	// Version selects the state of the product when it had the version
+	Version int
+}
+
+// stateAsOf returns the state of the product at asOf among its audit entries, the latest first
+func stateAsOf(entries []AuditEntry, asOf AsOf) (model.Product, error) {
+	for _, entry := range entries {
+		if asOf.Version > 0 {
+			// a purged product keeps the version it was deleted with
+			if entry.Action != AuditPurged && entry.Product.Version == asOf.Version {
+				return entry.Product, nil
+			}
+			continue
+		}
+		if !entry.Time.After(asOf.Time) {
+			if entry.Action == AuditPurged {
+				return model.Product{}, ErrNotFound
+			}
+			return entry.Product, nil
+		}
+	}
+	if asOf.Version > 0 {
+		return model.Product{}, ErrVersionNotFound
+	}
+	return model.Product{}, ErrNotFound
+}
+
+// diffProducts returns the fields that differ between the products, every field set in after
+// is a change when before is nil
+func diffProducts(before *model.Product, after model.Product) []FieldChange {
+	changes := []FieldChange{}
+	old := make([]string, len(auditFieldNames))
+	if before != nil {
+		old = auditFields(*before)
+	}
+	current := auditFields(after)
+	for i, field := range auditFieldNames {
+		if old[i] != current[i] {
+			changes = append(changes, FieldChange{Field: field, Before: old[i], After: current[i]})
+		}
+	}
+	return changes
+}
+
+// auditFieldNames are the product fields compared by the audit log
+var auditFieldNames = []string{"name", "description", "category", "amount", "deleted_at"}
+
+// auditFields returns the values of the audited fields of the product
+func auditFields(product model.Product) []string {
+	deletedAt := ""
+	if product.DeletedAt != nil {
+		deletedAt = product.DeletedAt.UTC().Format(time.RFC3339Nano)
+	}
+	return []string{product.Name, product.Description, product.Category, strconv.Itoa(product.Amount), deletedAt}
+}
+
+// outboxType returns the outbox event type of the audit action, a restored or reverted
+// product is updated
+func outboxType(action string) string {
+	if action == AuditRestored || action == AuditReverted {
+		return OutboxUpdated
+	}
+	return action
+}
+
+// record writes the product change in the audit log and in the outbox with q, which must be
+// the transaction of the change
+func (r *SQLRepository) record(ctx context.Context, q querier, action string, product model.Product) error {
+	if err := r.addAudit(ctx, q, action, product); err != nil {
+		return err
+	}
+	return r.addOutbox(ctx, q, outboxType(action), product)
+}
+
+// addAudit writes the product change in the audit log with q, which must be the transaction of
+// the change. The changed row is locked by the transaction so the previous entry is the latest one
+func (r *SQLRepository) addAudit(ctx context.Context, q querier, action string, product model.Product) error {
+	var before *model.Product
+	var snapshot string
+	switch err := q.QueryRowContext(ctx, r.dialect.rebind("SELECT product FROM product_audit WHERE product_id = ? ORDER BY id DESC LIMIT 1"), product.ID).Scan(&snapshot); err {
+	case sql.ErrNoRows:
+	case nil:
+		before = &model.Product{}
+		if err := json.Unmarshal([]byte(snapshot), before); err != nil {
+			return err
+		}
+	default:
+		return r.dialect.translate(err)
+	}
+
+	actor := ActorFromContext(ctx)
+	encoded, _ := json.Marshal(product)
+	changes, _ := json.Marshal(diffProducts(before, product))
+	_, err := q.ExecContext(ctx, r.dialect.rebind("INSERT INTO product_audit (product_id, action, actor, peer, changed_at, version, product, changes) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"),
+		product.ID, action, actor.Identity, actor.Peer, time.Now().UTC(), product.Version, string(encoded), string(changes))
+	return r.dialect.translate(err)
+}
+
+// ProductHistory returns the audit entries of the product, the latest first
+func (r *SQLRepository) ProductHistory(ctx context.Context, productID int, opts HistoryOptions) (HistoryResult, error) {
+	condition := "product_id = ?"
+	args := []interface{}{productID}
+	if opts.BeforeID > 0 {
+		condition += " AND id < ?"
+		args = append(args, opts.BeforeID)
+	}
+	limit := 0
+	if opts.Limit > 0 {
+		// one more entry tells whether another page follows
+		limit = opts.Limit + 1
+	}
+
+	entries, err := r.auditEntries(ctx, r.db, condition, args, limit)
+	if err != nil {
+		return HistoryResult{}, err
+	}
+
+	result := HistoryResult{Entries: entries}
+	if opts.Limit > 0 && len(entries) > opts.Limit {
+		result.Entries = entries[:opts.Limit]
+		result.HasMore = true
+	}
+	return result, nil
+}
+
+// GetAsOf returns the product as it was at asOf, a product deleted at the time is returned
+// with its deletion time
+func (r *SQLRepository) GetAsOf(ctx context.Context, id int, asOf AsOf) (model.Product, error) {
+	return r.getAsOf(ctx, r.db, id, asOf)
+}
+
+// getAsOf reads the only audit entry that can hold the state at asOf with q
+func (r *SQLRepository) getAsOf(ctx context.Context, q querier, id int, asOf AsOf) (model.Product, error) {
+	condition := "product_id = ? AND changed_at <= ?"
+	args := []interface{}{id, asOf.Time.UTC()}
+	if asOf.Version > 0 {
+		// a purged product keeps the version it was deleted with
+		condition = "product_id = ? AND version = ? AND action <> ?"
+		args = []interface{}{id, asOf.Version, AuditPurged}
+	}
+
+	entries, err := r.auditEntries(ctx, q, condition, args, 1)
+	if err != nil {
+		return model.Product{}, err
+	}
+	return stateAsOf(entries, asOf)
+}
+
+// Revert restores the name, description, category and amount the product had at the version
+// as a new write, the product must have expectedVersion unless it is 0
+func (r *SQLRepository) Revert(ctx context.Context, id int, version int, expectedVersion int) (model.Product, error) {
+	var reverted model.Product
+	err := r.inTx(ctx, func(tx *sql.Tx) error {
+		snapshot, err := r.getAsOf(ctx, tx, id, AsOf{Version: version})
+		if err != nil {
+			return err
+		}
+
+		condition, conditionArgs := versionCondition(id, expectedVersion)
+		args := append([]interface{}{snapshot.Name, snapshot.Description, snapshot.Category, snapshot.Amount}, conditionArgs...)
+		row := tx.QueryRowContext(ctx, r.dialect.rebind("UPDATE products SET name=?, description=?, category=?, amount=?, version=version+1 WHERE "+condition+" RETURNING "+productColumns), args...)
+		switch reverted, err = scanProduct(row); err {
+		case sql.ErrNoRows:
+			return r.missingError(ctx, tx, id)
+		case nil:
+			return r.record(ctx, tx, AuditReverted, reverted)
+		default:
+			return r.dialect.translate(err)
+		}
+	})
+	if err != nil {
+		return model.Product{}, err
+	}
+	return reverted, nil
+}
+
+// auditEntries returns the audit entries matching the condition, the latest first. At most
+// limit entries are returned unless it is 0
+func (r *SQLRepository) auditEntries(ctx context.Context, q querier, condition string, args []interface{}, limit int) ([]AuditEntry, error) {
+	query := "SELECT id, product_id, action, actor, peer, changed_at, product, changes FROM product_audit WHERE " + condition + " ORDER BY id DESC"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := q.QueryContext(ctx, r.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, r.dialect.translate(err)
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		entry := AuditEntry{}
+		var product, changes string
+		if err := rows.Scan(&entry.ID, &entry.ProductID, &entry.Action, &entry.Actor.Identity, &entry.Actor.Peer, &entry.Time, &product, &changes); err != nil {
+			return nil, r.dialect.translate(err)
+		}
+		if err := json.Unmarshal([]byte(product), &entry.Product); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(changes), &entry.Changes); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, r.dialect.translate(rows.Err())
+}
+
+// record writes the product change in the audit log and in the outbox, the repository must
+// be locked
+func (r *MemoryRepository) record(ctx context.Context, action string, product model.Product) {
+	var before *model.Product
+	for i := len(r.audit) - 1; i >= 0; i-- {
+		if r.audit[i].ProductID == product.ID {
+			before = &r.audit[i].Product
+			break
+		}
+	}
+
+	r.lastAuditID++
+	r.audit = append(r.audit, AuditEntry{
+		ID:        r.lastAuditID,
+		ProductID: product.ID,
+		Action:    action,
+		Actor:     ActorFromContext(ctx),
+		Time:      time.Now().UTC(),
+		Product:   product,
+		Changes:   diffProducts(before, product),
+	})
+	r.addOutbox(outboxType(action), product)
+}
+
+// ProductHistory returns the audit entries of the product, the latest first
+func (r *MemoryRepository) ProductHistory(ctx context.Context, productID int, opts HistoryOptions) (HistoryResult, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	result := HistoryResult{Entries: []AuditEntry{}}
+	for i := len(r.audit) - 1; i >= 0; i-- {
+		entry := r.audit[i]
+		if entry.ProductID != productID || (opts.BeforeID > 0 && entry.ID >= opts.BeforeID) {
+			continue
+		}
+		if opts.Limit > 0 && len(result.Entries) == opts.Limit {
+			result.HasMore = true
+			break
+		}
+		result.Entries = append(result.Entries, entry)
+	}
+	return result, nil
+}
+
+// GetAsOf returns the product as it was at asOf, a product deleted at the time is returned
+// with its deletion time
+func (r *MemoryRepository) GetAsOf(ctx context.Context, id int, asOf AsOf) (model.Product, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return stateAsOf(r.productAudit(id), asOf)
+}
+
+// Revert restores the name, description, category and amount the product had at the version
+// as a new write, the product must have expectedVersion unless it is 0
+func (r *MemoryRepository) Revert(ctx context.Context, id int, version int, expectedVersion int) (model.Product, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	snapshot, err := stateAsOf(r.productAudit(id), AsOf{Version: version})
+	if err != nil {
+		return model.Product{}, err
+	}
+	snapshot.Version = expectedVersion
+	return r.change(ctx, AuditReverted, id, snapshot, nil)
+}
+
+// productAudit returns the audit entries of the product, the latest first. The repository
+// must be locked
+func (r *MemoryRepository) productAudit(id int) []AuditEntry {
+	entries := []AuditEntry{}
+	for i := len(r.audit) - 1; i >= 0; i-- {
+		if r.audit[i].ProductID == id {
+			entries = append(entries, r.audit[i])
+		}
+	}
+	return entries
+}
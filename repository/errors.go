@@ -0,0 +1,52 @@
+package repository
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net"
+)
+
+// ErrorKind classifies the database errors translated by the SQL repository
+type ErrorKind int
+
+const (
+	// Duplicate means a unique constraint rejected the write
+	Duplicate ErrorKind = iota + 1
+	// InvalidData means a not null or check constraint rejected the written values
+	InvalidData
+	// Conflict means the transaction collided with a concurrent one and can be retried
+	Conflict
+	// Unavailable means the database could not be reached
+	Unavailable
+)
+
+// Error represents a database error translated from the driver error. Err keeps the
+// driver error for logging, it may contain SQL and must not be sent to clients
+type Error struct {
+	Kind ErrorKind
+	// Constraint is the name of the violated constraint, when known
+	Constraint string
+	// Column is the name of the rejected column, when known
+	Column string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports a Duplicate error as ErrAlreadyExists, the only unique column of
+// products is the name
+func (e *Error) Is(target error) bool {
+	return target == ErrAlreadyExists && e.Kind == Duplicate
+}
+
+// isConnectionError reports whether err means the database connection is broken
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.As(err, &netErr)
+}
@@ -0,0 +1,120 @@
+package repository
+
+import (
+	"context"
+	"time"
+)
+
+// IdempotencyRecord represents the stored outcome of a write made with an idempotency key
+type IdempotencyRecord struct {
+	Key string
+	// RequestHash identifies the request that reserved the key
+	RequestHash string
+	// Response is the encoded response of the write, nil while the write is in progress
+	Response []byte
+	// ExpiresAt ends the reservation of a write in progress and the record of a completed one
+	ExpiresAt time.Time
+}
+
+// IdempotencyStore represents the storage of idempotency keys
+type IdempotencyStore interface {
+	// Reserve stores a record without response for the key of the record and reports true,
+	// when an unexpired record already has the key it is returned instead with false
+	Reserve(ctx context.Context, record IdempotencyRecord) (IdempotencyRecord, bool, error)
+	// Complete stores the response of the write made with the reserved key and keeps it until
+	// expiresAt
+	Complete(ctx context.Context, key string, response []byte, expiresAt time.Time) error
+	// Release removes the reservation of a key whose write failed so it can be retried
+	Release(ctx context.Context, key string) error
+}
+
+// Reserve removes the expired keys and stores the record unless its key is already used
+func (r *SQLRepository) Reserve(ctx context.Context, record IdempotencyRecord) (IdempotencyRecord, bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return IdempotencyRecord{}, false, r.dialect.translate(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, r.dialect.rebind("DELETE FROM idempotency_keys WHERE expires_at <= ?"), time.Now().UTC()); err != nil {
+		return IdempotencyRecord{}, false, r.dialect.translate(err)
+	}
+
+	result, err := tx.ExecContext(ctx, r.dialect.rebind("INSERT INTO idempotency_keys (key, request_hash, expires_at) VALUES (?, ?, ?) ON CONFLICT (key) DO NOTHING"), record.Key, record.RequestHash, record.ExpiresAt.UTC())
+	if err != nil {
+		return IdempotencyRecord{}, false, r.dialect.translate(err)
+	}
+	reserved, err := result.RowsAffected()
+	if err != nil {
+		return IdempotencyRecord{}, false, r.dialect.translate(err)
+	}
+
+	if reserved == 0 {
+		record = IdempotencyRecord{Key: record.Key}
+		row := tx.QueryRowContext(ctx, r.dialect.rebind("SELECT request_hash, response, expires_at FROM idempotency_keys WHERE key = ?"), record.Key)
+		if err := row.Scan(&record.RequestHash, &record.Response, &record.ExpiresAt); err != nil {
+			return IdempotencyRecord{}, false, r.dialect.translate(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return IdempotencyRecord{}, false, r.dialect.translate(err)
+	}
+	return record, reserved > 0, nil
+}
+
+// Complete stores the response of the reserved key
+func (r *SQLRepository) Complete(ctx context.Context, key string, response []byte, expiresAt time.Time) error {
+	_, err := r.db.ExecContext(ctx, r.dialect.rebind("UPDATE idempotency_keys SET response=?, expires_at=? WHERE key = ?"), response, expiresAt.UTC(), key)
+	return r.dialect.translate(err)
+}
+
+// Release removes the key unless its write was completed
+func (r *SQLRepository) Release(ctx context.Context, key string) error {
+	_, err := r.db.ExecContext(ctx, r.dialect.rebind("DELETE FROM idempotency_keys WHERE key = ? AND response IS NULL"), key)
+	return r.dialect.translate(err)
+}
+
+// Reserve removes the expired keys and stores the record unless its key is already used
+func (r *MemoryRepository) Reserve(ctx context.Context, record IdempotencyRecord) (IdempotencyRecord, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for key, stored := range r.idempotencyKeys {
+		if !stored.ExpiresAt.After(now) {
+			delete(r.idempotencyKeys, key)
+		}
+	}
+
+	if stored, exists := r.idempotencyKeys[record.Key]; exists {
+		return stored, false, nil
+	}
+	record.Response = nil
+	r.idempotencyKeys[record.Key] = record
+	return record, true, nil
+}
+
+// Complete stores the response of the reserved key
+func (r *MemoryRepository) Complete(ctx context.Context, key string, response []byte, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if record, exists := r.idempotencyKeys[key]; exists {
+		record.Response = response
+		record.ExpiresAt = expiresAt
+		r.idempotencyKeys[key] = record
+	}
+	return nil
+}
+
+// Release removes the key unless its write was completed
+func (r *MemoryRepository) Release(ctx context.Context, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if record, exists := r.idempotencyKeys[key]; exists && record.Response == nil {
+		delete(r.idempotencyKeys, key)
+	}
+	return nil
+}
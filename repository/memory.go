@@ -0,0 +1,335 @@
+package repository
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nadirbasalamah/go-simple-grpc/model"
+)
+
+// MemoryRepository represents product repository that keeps data in memory,
+// it is safe for concurrent use
+type MemoryRepository struct {
+	mu       sync.RWMutex
+	lastID   int
+	products map[int]model.Product
+	names    map[string]int
+	// idempotencyKeys holds the idempotency records by key
+	idempotencyKeys map[string]IdempotencyRecord
+	// outbox holds the outbox messages in the order they were written
+	lastOutboxID int64
+	outbox       []memoryOutboxMessage
+	// audit holds the audit entries in the order they were written
+	lastAuditID int64
+	audit       []AuditEntry
+}
+
+// NewMemoryRepository returns an empty in-memory product repository
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		products:        map[int]model.Product{},
+		names:           map[string]int{},
+		idempotencyKeys: map[string]IdempotencyRecord{},
+	}
+}
+
+// Create stores a new product and returns it with the generated id
+func (r *MemoryRepository) Create(ctx context.Context, product model.Product) (model.Product, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.create(ctx, product)
+}
+
+func (r *MemoryRepository) create(ctx context.Context, product model.Product) (model.Product, error) {
+	if _, exists := r.names[product.Name]; exists {
+		return model.Product{}, ErrAlreadyExists
+	}
+
+	r.lastID++
+	stored := product
+	stored.ID = r.lastID
+	stored.Version = 1
+	stored.DeletedAt = nil
+	r.products[stored.ID] = stored
+	r.names[stored.Name] = stored.ID
+	r.record(ctx, AuditCreated, stored)
+
+	return stored, nil
+}
+
+// Get returns specific product by id, soft deleted products are only returned when
+// showDeleted is set
+func (r *MemoryRepository) Get(ctx context.Context, id int, showDeleted bool) (model.Product, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	product, ok := r.products[id]
+	if !ok || (product.DeletedAt != nil && !showDeleted) {
+		return model.Product{}, ErrNotFound
+	}
+	return product, nil
+}
+
+// Update replaces the given fields of the product with the id, every field when none is
+// given, and returns the stored product
+func (r *MemoryRepository) Update(ctx context.Context, id int, product model.Product, fields []string) (model.Product, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.update(ctx, id, product, fields)
+}
+
+func (r *MemoryRepository) update(ctx context.Context, id int, product model.Product, fields []string) (model.Product, error) {
+	return r.change(ctx, AuditUpdated, id, product, fields)
+}
+
+// change replaces the given fields of the product and records the change with action
+func (r *MemoryRepository) change(ctx context.Context, action string, id int, product model.Product, fields []string) (model.Product, error) {
+	current, ok := r.products[id]
+	if !ok || current.DeletedAt != nil {
+		return model.Product{}, ErrNotFound
+	}
+	if product.Version != 0 && product.Version != current.Version {
+		return model.Product{}, ErrVersionMismatch
+	}
+	if len(fields) == 0 {
+		fields = model.ProductFields
+	}
+
+	stored := current
+	stored.Version++
+	for _, field := range fields {
+		switch field {
+		case "name":
+			stored.Name = product.Name
+		case "description":
+			stored.Description = product.Description
+		case "category":
+			stored.Category = product.Category
+		case "amount":
+			stored.Amount = product.Amount
+		default:
+			panic("unknown product field " + field)
+		}
+	}
+	if ownerID, exists := r.names[stored.Name]; exists && ownerID != id {
+		return model.Product{}, ErrAlreadyExists
+	}
+
+	delete(r.names, current.Name)
+	r.products[id] = stored
+	r.names[stored.Name] = id
+	r.record(ctx, action, stored)
+
+	return stored, nil
+}
+
+// Delete soft deletes the product data with the given id
+func (r *MemoryRepository) Delete(ctx context.Context, id int, expectedVersion int) (model.Product, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	product, ok := r.products[id]
+	if !ok || product.DeletedAt != nil {
+		return model.Product{}, ErrNotFound
+	}
+	if expectedVersion != 0 && expectedVersion != product.Version {
+		return model.Product{}, ErrVersionMismatch
+	}
+
+	deletedAt := time.Now().UTC()
+	product.DeletedAt = &deletedAt
+	product.Version++
+	r.products[id] = product
+	r.record(ctx, AuditDeleted, product)
+	return product, nil
+}
+
+// Undelete restores the soft deleted product with the given id
+func (r *MemoryRepository) Undelete(ctx context.Context, id int) (model.Product, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	product, ok := r.products[id]
+	if !ok {
+		return model.Product{}, ErrNotFound
+	}
+	if product.DeletedAt == nil {
+		return model.Product{}, ErrNotDeleted
+	}
+
+	product.DeletedAt = nil
+	product.Version++
+	r.products[id] = product
+	r.record(ctx, AuditRestored, product)
+	return product, nil
+}
+
+// PurgeDeleted permanently removes the products deleted before the given time
+func (r *MemoryRepository) PurgeDeleted(ctx context.Context, deletedBefore time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	purged := 0
+	for id, product := range r.products {
+		if product.DeletedAt != nil && product.DeletedAt.Before(deletedBefore) {
+			delete(r.names, product.Name)
+			delete(r.products, id)
+			r.record(ctx, AuditPurged, product)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// List returns the products matching the options in the requested order
+func (r *MemoryRepository) List(ctx context.Context, opts ListOptions) (ListResult, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	products := []model.Product{}
+	totalCount := 0
+	for _, product := range r.products {
+		if !matches(product, opts.Filter) {
+			continue
+		}
+		totalCount++
+		if opts.After != nil && !less(*opts.After, product, opts.SortBy, opts.Descending) {
+			continue
+		}
+		products = append(products, product)
+	}
+	sort.Slice(products, func(i, j int) bool {
+		return less(products[i], products[j], opts.SortBy, opts.Descending)
+	})
+
+	result := ListResult{Products: products, TotalCount: totalCount}
+	if opts.Limit > 0 && len(products) > opts.Limit {
+		result.Products = products[:opts.Limit]
+		result.HasMore = true
+	}
+	return result, nil
+}
+
+// matches reports whether the product satisfies the filter
+func matches(product model.Product, filter model.ProductFilter) bool {
+	if product.DeletedAt != nil && !filter.ShowDeleted {
+		return false
+	}
+	if filter.Category != "" && product.Category != filter.Category {
+		return false
+	}
+	if filter.NamePrefix != "" && !strings.HasPrefix(strings.ToLower(product.Name), strings.ToLower(filter.NamePrefix)) {
+		return false
+	}
+	if filter.MinAmount != nil && product.Amount < *filter.MinAmount {
+		return false
+	}
+	if filter.MaxAmount != nil && product.Amount > *filter.MaxAmount {
+		return false
+	}
+	return true
+}
+
+// less reports whether a comes before b in the sort order, id breaks the ties
+func less(a, b model.Product, field model.SortField, descending bool) bool {
+	if descending {
+		a, b = b, a
+	}
+	switch field {
+	case model.SortByName:
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+	case model.SortByAmount:
+		if a.Amount != b.Amount {
+			return a.Amount < b.Amount
+		}
+	}
+	return a.ID < b.ID
+}
+
+// Search returns the products matching the keywords of the options, the most relevant first
+func (r *MemoryRepository) Search(ctx context.Context, opts SearchOptions) (SearchResult, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	products := []model.Product{}
+	for _, product := range r.products {
+		if product.DeletedAt == nil {
+			products = append(products, product)
+		}
+	}
+	return substringSearch(products, opts), nil
+}
+
+// BatchCreate stores multiple products at once, in atomic mode a failed product
+// removes the products already created by the batch
+func (r *MemoryRepository) BatchCreate(ctx context.Context, products []model.Product, atomic bool) ([]BatchResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lastID, lastOutboxID, outboxSize := r.lastID, r.lastOutboxID, len(r.outbox)
+	lastAuditID, auditSize := r.lastAuditID, len(r.audit)
+	results := make([]BatchResult, len(products))
+	for i, product := range products {
+		results[i].Product, results[i].Err = r.create(ctx, product)
+		results[i].Created = results[i].Err == nil
+		if results[i].Err == nil || !atomic {
+			continue
+		}
+
+		for _, result := range results[:i] {
+			delete(r.names, result.Product.Name)
+			delete(r.products, result.Product.ID)
+		}
+		r.lastID, r.lastOutboxID, r.outbox = lastID, lastOutboxID, r.outbox[:outboxSize]
+		r.lastAuditID, r.audit = lastAuditID, r.audit[:auditSize]
+		return abortBatch(results, i), nil
+	}
+	return results, nil
+}
+
+// UpsertByName creates the product or updates the product with the same name
+func (r *MemoryRepository) UpsertByName(ctx context.Context, product model.Product) (model.Product, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id, exists := r.names[product.Name]
+	if !exists {
+		created, err := r.create(ctx, product)
+		return created, err == nil, err
+	}
+
+	stored := r.products[id]
+	stored.Description = product.Description
+	stored.Category = product.Category
+	stored.Amount = product.Amount
+	stored.Version++
+	stored.DeletedAt = nil
+	r.products[id] = stored
+	r.record(ctx, AuditUpdated, stored)
+
+	return stored, false, nil
+}
+
+// BatchUpsert updates the products that have an id and creates the others at once
+func (r *MemoryRepository) BatchUpsert(ctx context.Context, products []model.Product) ([]BatchResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	results := make([]BatchResult, len(products))
+	for i, product := range products {
+		if product.ID == 0 {
+			results[i].Product, results[i].Err = r.create(ctx, product)
+			results[i].Created = results[i].Err == nil
+		} else {
+			results[i].Product, results[i].Err = r.update(ctx, product.ID, product, nil)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,295 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/nadirbasalamah/go-simple-grpc/model"
+)
+
+// Outbox event types
+const (
+	OutboxCreated = "created"
+	OutboxUpdated = "updated"
+	OutboxDeleted = "deleted"
+	OutboxPurged  = "purged"
+)
+
+// OutboxMessage represents a product change written in the outbox by the transaction of
+// the change, waiting to be delivered
+type OutboxMessage struct {
+	ID int64
+	// Payload is the JSON encoded OutboxEvent
+	Payload   []byte
+	CreatedAt time.Time
+	// Attempts counts the failed deliveries
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+}
+
+// OutboxEvent represents the change described by an outbox message
+type OutboxEvent struct {
+	Type    string        `json:"type"`
+	Product model.Product `json:"product"`
+	Time    time.Time     `json:"time"`
+}
+
+// OutboxStore represents the storage of the outbox messages. The messages are claimed before
+// their delivery so only one claimer delivers them at a time, in the order they were written
+type OutboxStore interface {
+	// ClaimOutbox claims the oldest undelivered messages for the lease duration and returns
+	// them in the order they were written, it returns no message while another claimer holds
+	// the oldest one
+	ClaimOutbox(ctx context.Context, claim string, limit int, lease time.Duration) ([]OutboxMessage, error)
+	// MarkOutboxDelivered records the delivery of the claimed message, it returns ErrClaimLost
+	// when the claim expired and was taken by another claimer
+	MarkOutboxDelivered(ctx context.Context, claim string, id int64) error
+	// MarkOutboxFailed records a failed delivery of the claimed message and when to retry it,
+	// and releases the message
+	MarkOutboxFailed(ctx context.Context, claim string, id int64, nextAttemptAt time.Time, reason string) error
+	// ReleaseOutbox releases the undelivered messages of the claim
+	ReleaseOutbox(ctx context.Context, claim string) error
+	// PurgeDelivered removes the messages delivered before the given time and returns how
+	// many were removed
+	PurgeDelivered(ctx context.Context, deliveredBefore time.Time) (int, error)
+}
+
+// outboxPayload returns the encoded event of the product change
+func outboxPayload(eventType string, product model.Product, now time.Time) []byte {
+	payload, _ := json.Marshal(OutboxEvent{Type: eventType, Product: product, Time: now})
+	return payload
+}
+
+// addOutbox writes the product change in the outbox with q, which must be the transaction
+// of the change
+func (r *SQLRepository) addOutbox(ctx context.Context, q querier, eventType string, product model.Product) error {
+	now := time.Now().UTC()
+	_, err := q.ExecContext(ctx, r.dialect.rebind("INSERT INTO outbox (payload, created_at, next_attempt_at) VALUES (?, ?, ?)"), string(outboxPayload(eventType, product, now)), now, now)
+	return r.dialect.translate(err)
+}
+
+// outboxColumns lists the outbox columns in the order expected by scanOutboxMessage
+const outboxColumns = "id, payload, created_at, attempts, next_attempt_at, last_error"
+
+// scanOutboxMessage reads the outboxColumns of a row followed by the extra columns
+func scanOutboxMessage(row scanner, extra ...interface{}) (OutboxMessage, error) {
+	message := OutboxMessage{}
+	var payload string
+	var lastError sql.NullString
+	dest := append([]interface{}{&message.ID, &payload, &message.CreatedAt, &message.Attempts, &message.NextAttemptAt, &lastError}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return OutboxMessage{}, err
+	}
+	message.Payload = []byte(payload)
+	message.LastError = lastError.String
+	return message, nil
+}
+
+// ClaimOutbox claims the oldest undelivered messages for the lease duration, the messages
+// are locked while they are claimed so concurrent claimers wait for each other
+func (r *SQLRepository) ClaimOutbox(ctx context.Context, claim string, limit int, lease time.Duration) ([]OutboxMessage, error) {
+	messages := []OutboxMessage{}
+	err := r.inTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now().UTC()
+		rows, err := tx.QueryContext(ctx, r.dialect.rebind("SELECT "+outboxColumns+", claim_token, claimed_until FROM outbox WHERE delivered_at IS NULL ORDER BY id LIMIT ?"+r.dialect.forUpdate()), limit)
+		if err != nil {
+			return r.dialect.translate(err)
+		}
+
+		defer rows.Close()
+		for rows.Next() {
+			var claimToken sql.NullString
+			var claimedUntil sql.NullTime
+			message, err := scanOutboxMessage(rows, &claimToken, &claimedUntil)
+			if err != nil {
+				return r.dialect.translate(err)
+			}
+			// the messages from the one held by another claimer are left to that claimer
+			if claimToken.Valid && claimToken.String != claim && claimedUntil.Time.After(now) {
+				break
+			}
+			messages = append(messages, message)
+		}
+		if err := rows.Err(); err != nil {
+			return r.dialect.translate(err)
+		}
+		rows.Close()
+
+		for _, message := range messages {
+			if _, err := tx.ExecContext(ctx, r.dialect.rebind("UPDATE outbox SET claim_token=?, claimed_until=? WHERE id = ?"), claim, now.Add(lease), message.ID); err != nil {
+				return r.dialect.translate(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// MarkOutboxDelivered records the delivery of the claimed message
+func (r *SQLRepository) MarkOutboxDelivered(ctx context.Context, claim string, id int64) error {
+	result, err := r.db.ExecContext(ctx, r.dialect.rebind("UPDATE outbox SET delivered_at=?, claim_token=NULL, claimed_until=NULL WHERE id = ? AND claim_token = ?"), time.Now().UTC(), id, claim)
+	return r.claimed(result, err)
+}
+
+// MarkOutboxFailed records a failed delivery of the claimed message and when to retry it
+func (r *SQLRepository) MarkOutboxFailed(ctx context.Context, claim string, id int64, nextAttemptAt time.Time, reason string) error {
+	result, err := r.db.ExecContext(ctx, r.dialect.rebind("UPDATE outbox SET attempts=attempts+1, next_attempt_at=?, last_error=?, claim_token=NULL, claimed_until=NULL WHERE id = ? AND claim_token = ?"), nextAttemptAt.UTC(), reason, id, claim)
+	return r.claimed(result, err)
+}
+
+// ReleaseOutbox releases the undelivered messages of the claim
+func (r *SQLRepository) ReleaseOutbox(ctx context.Context, claim string) error {
+	_, err := r.db.ExecContext(ctx, r.dialect.rebind("UPDATE outbox SET claim_token=NULL, claimed_until=NULL WHERE claim_token = ? AND delivered_at IS NULL"), claim)
+	return r.dialect.translate(err)
+}
+
+// claimed returns ErrClaimLost when the update of a claimed message changed no row
+func (r *SQLRepository) claimed(result sql.Result, err error) error {
+	if err != nil {
+		return r.dialect.translate(err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return r.dialect.translate(err)
+	}
+	if updated == 0 {
+		return ErrClaimLost
+	}
+	return nil
+}
+
+// PurgeDelivered removes the messages delivered before the given time
+func (r *SQLRepository) PurgeDelivered(ctx context.Context, deliveredBefore time.Time) (int, error) {
+	result, err := r.db.ExecContext(ctx, r.dialect.rebind("DELETE FROM outbox WHERE delivered_at IS NOT NULL AND delivered_at < ?"), deliveredBefore.UTC())
+	if err != nil {
+		return 0, r.dialect.translate(err)
+	}
+
+	purged, err := result.RowsAffected()
+	return int(purged), r.dialect.translate(err)
+}
+
+// addOutbox writes the product change in the outbox, the repository must be locked
+func (r *MemoryRepository) addOutbox(eventType string, product model.Product) {
+	now := time.Now().UTC()
+	r.lastOutboxID++
+	r.outbox = append(r.outbox, memoryOutboxMessage{
+		OutboxMessage: OutboxMessage{
+			ID:            r.lastOutboxID,
+			Payload:       outboxPayload(eventType, product, now),
+			CreatedAt:     now,
+			NextAttemptAt: now,
+		},
+	})
+}
+
+// ClaimOutbox claims the oldest undelivered messages for the lease duration
+func (r *MemoryRepository) ClaimOutbox(ctx context.Context, claim string, limit int, lease time.Duration) ([]OutboxMessage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
+	messages := []OutboxMessage{}
+	for i := range r.outbox {
+		message := &r.outbox[i]
+		if len(messages) == limit {
+			break
+		}
+		if message.deliveredAt != nil {
+			continue
+		}
+		// the messages from the one held by another claimer are left to that claimer
+		if message.claim != "" && message.claim != claim && message.claimedUntil.After(now) {
+			break
+		}
+		message.claim = claim
+		message.claimedUntil = now.Add(lease)
+		messages = append(messages, message.OutboxMessage)
+	}
+	return messages, nil
+}
+
+// MarkOutboxDelivered records the delivery of the claimed message
+func (r *MemoryRepository) MarkOutboxDelivered(ctx context.Context, claim string, id int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	message := r.claimedOutbox(claim, id)
+	if message == nil {
+		return ErrClaimLost
+	}
+	deliveredAt := time.Now().UTC()
+	message.deliveredAt = &deliveredAt
+	message.claim = ""
+	return nil
+}
+
+// MarkOutboxFailed records a failed delivery of the claimed message and when to retry it
+func (r *MemoryRepository) MarkOutboxFailed(ctx context.Context, claim string, id int64, nextAttemptAt time.Time, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	message := r.claimedOutbox(claim, id)
+	if message == nil {
+		return ErrClaimLost
+	}
+	message.Attempts++
+	message.NextAttemptAt = nextAttemptAt
+	message.LastError = reason
+	message.claim = ""
+	return nil
+}
+
+// ReleaseOutbox releases the undelivered messages of the claim
+func (r *MemoryRepository) ReleaseOutbox(ctx context.Context, claim string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.outbox {
+		if r.outbox[i].claim == claim {
+			r.outbox[i].claim = ""
+		}
+	}
+	return nil
+}
+
+// claimedOutbox returns the message with the id if it is held by the claim, the repository
+// must be locked
+func (r *MemoryRepository) claimedOutbox(claim string, id int64) *memoryOutboxMessage {
+	for i := range r.outbox {
+		if r.outbox[i].ID == id && r.outbox[i].claim == claim {
+			return &r.outbox[i]
+		}
+	}
+	return nil
+}
+
+// PurgeDelivered removes the messages delivered before the given time
+func (r *MemoryRepository) PurgeDelivered(ctx context.Context, deliveredBefore time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	kept := []memoryOutboxMessage{}
+	for _, message := range r.outbox {
+		if message.deliveredAt == nil || !message.deliveredAt.Before(deliveredBefore) {
+			kept = append(kept, message)
+		}
+	}
+	purged := len(r.outbox) - len(kept)
+	r.outbox = kept
+	return purged, nil
+}
+
+// memoryOutboxMessage represents an outbox message with its delivery time and claim
+type memoryOutboxMessage struct {
+	OutboxMessage
+	deliveredAt  *time.Time
+	claim        string
+	claimedUntil time.Time
+}
@@ -0,0 +1,132 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// searchDocument is the weighted text search document of a product, it must stay identical
+// to the expression of the products_search_idx index so the index is used
+const searchDocument = "setweight(to_tsvector('english', coalesce(name, '')), 'A') || " +
+	"setweight(to_tsvector('english', coalesce(description, '')), 'B') || " +
+	"setweight(to_tsvector('english', coalesce(category, '')), 'C')"
+
+type postgresDialect struct{}
+
+// NewPostgresRepository returns product repository that uses the given PostgreSQL database
+func NewPostgresRepository(db *sql.DB) *SQLRepository {
+	return &SQLRepository{db: db, dialect: postgresDialect{}}
+}
+
+// rebind converts the ? placeholders into $1, $2, ... bind variables
+func (postgresDialect) rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c != '?' {
+			b.WriteRune(c)
+			continue
+		}
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+// translate converts the PostgreSQL errors into repository errors
+func (postgresDialect) translate(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		if isConnectionError(err) {
+			return &Error{Kind: Unavailable, Err: err}
+		}
+		return err
+	}
+
+	switch pqErr.Code.Name() {
+	case "unique_violation":
+		return &Error{Kind: Duplicate, Constraint: pqErr.Constraint, Column: pqErr.Column, Err: err}
+	case "not_null_violation", "check_violation":
+		return &Error{Kind: InvalidData, Constraint: pqErr.Constraint, Column: pqErr.Column, Err: err}
+	case "serialization_failure", "deadlock_detected":
+		return &Error{Kind: Conflict, Err: err}
+	}
+
+	switch pqErr.Code.Class() {
+	// connection exception and operator intervention, e.g. the server is shutting down
+	case "08", "57":
+		return &Error{Kind: Unavailable, Err: err}
+	}
+	return err
+}
+
+// forUpdate locks the rows so concurrent transactions wait for each other
+func (postgresDialect) forUpdate() string {
+	return " FOR UPDATE"
+}
+
+// search finds the products with the full-text search index, ranks them with ts_rank and
+// highlights them with ts_headline
+func (d postgresDialect) search(ctx context.Context, q querier, opts SearchOptions) (SearchResult, error) {
+	matches := "SELECT " + productColumns + ", ts_rank(" + searchDocument + ", query) AS rank FROM products, plainto_tsquery('english', ?) query " +
+		"WHERE deleted_at IS NULL AND (" + searchDocument + ") @@ query"
+
+	rows, err := q.QueryContext(ctx, d.rebind("SELECT category, count(*) FROM ("+matches+") matches GROUP BY category ORDER BY count(*) DESC, category"), opts.Query)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	defer rows.Close()
+
+	result := SearchResult{Hits: []SearchHit{}, Facets: []CategoryFacet{}}
+	for rows.Next() {
+		facet := CategoryFacet{}
+		if err := rows.Scan(&facet.Category, &facet.Count); err != nil {
+			return SearchResult{}, err
+		}
+		result.Facets = append(result.Facets, facet)
+		if opts.Category == "" || opts.Category == facet.Category {
+			result.TotalCount += facet.Count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return SearchResult{}, err
+	}
+	if result.TotalCount <= opts.Offset {
+		return result, nil
+	}
+
+	// ts_headline is slow, it only runs for the returned page
+	args := []interface{}{opts.Query, opts.Query}
+	if opts.Category != "" {
+		matches += " AND category = ?"
+		args = append(args, opts.Category)
+	}
+	limit := "ALL"
+	if opts.Limit > 0 {
+		limit = strconv.Itoa(opts.Limit)
+	}
+	args = append(args, opts.Offset)
+
+	hits, err := q.QueryContext(ctx, d.rebind("SELECT "+productColumns+", rank, "+
+		"ts_headline('english', trim(coalesce(name, '') || ' ' || coalesce(description, '')), plainto_tsquery('english', ?), 'StartSel=<b>, StopSel=</b>') "+
+		"FROM ("+matches+" ORDER BY rank DESC, id LIMIT "+limit+" OFFSET ?) hits ORDER BY rank DESC, id"), args...)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	defer hits.Close()
+
+	for hits.Next() {
+		hit := SearchHit{}
+		if hit.Product, err = scanProduct(hits, &hit.Rank, &hit.Highlight); err != nil {
+			return SearchResult{}, err
+		}
+		result.Hits = append(result.Hits, hit)
+	}
+	result.HasMore = opts.Offset+len(result.Hits) < result.TotalCount
+	return result, hits.Err()
+}
@@ -0,0 +1,122 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nadirbasalamah/go-simple-grpc/model"
+)
+
+var (
+	// ErrNotFound is returned when the requested product does not exist
+	ErrNotFound = errors.New("product not found")
+	// ErrAlreadyExists is returned when another product already uses the same name
+	ErrAlreadyExists = errors.New("product name already exists")
+	// ErrBatchAborted is reported for the products of an atomic batch that were not stored
+	// because another product of the batch failed
+	ErrBatchAborted = errors.New("batch aborted by another failed product")
+	// ErrVersionMismatch is returned when the product was changed since the expected version
+	ErrVersionMismatch = errors.New("product version mismatch")
+	// ErrNotDeleted is returned when restoring a product that is not deleted
+	ErrNotDeleted = errors.New("product is not deleted")
+	// ErrVersionNotFound is returned when the history of the product has no such version
+	ErrVersionNotFound = errors.New("product version not found")
+	// ErrClaimLost is returned when marking an outbox message whose claim expired and was
+	// taken by another claimer
+	ErrClaimLost = errors.New("outbox claim lost")
+)
+
+// Storage represents a storage of products with its idempotency keys and outbox, every
+// product change is written in the outbox by the same transaction
+type Storage interface {
+	ProductRepository
+	IdempotencyStore
+	OutboxStore
+}
+
+// ProductRepository represents the storage of product data
+type ProductRepository interface {
+	// Create stores a new product and returns it with the generated id
+	Create(ctx context.Context, product model.Product) (model.Product, error)
+	// Get returns specific product by id, soft deleted products are only returned when
+	// showDeleted is set
+	Get(ctx context.Context, id int, showDeleted bool) (model.Product, error)
+	// Update replaces the given fields of the product with the id, every field when none is
+	// given, and returns the stored product. ErrNotFound is returned when no product has the id
+	// and ErrVersionMismatch when the product version is set but differs from the stored one
+	Update(ctx context.Context, id int, product model.Product, fields []string) (model.Product, error)
+	// Delete soft deletes the product data with the given id and returns the deleted product,
+	// ErrNotFound is returned when no product has the id and ErrVersionMismatch when
+	// expectedVersion is set but differs. A deleted product keeps its name until it is purged
+	Delete(ctx context.Context, id int, expectedVersion int) (model.Product, error)
+	// Undelete restores the soft deleted product with the given id
+	Undelete(ctx context.Context, id int) (model.Product, error)
+	// PurgeDeleted permanently removes the products deleted before the given time and
+	// returns how many were removed
+	PurgeDeleted(ctx context.Context, deletedBefore time.Time) (int, error)
+	// List returns the products matching the options in the requested order
+	List(ctx context.Context, opts ListOptions) (ListResult, error)
+	// Search returns the products that aren't deleted and match the keywords of the options,
+	// the most relevant first
+	Search(ctx context.Context, opts SearchOptions) (SearchResult, error)
+	// UpsertByName creates the product, or updates the product with the same name, and reports
+	// whether it was created. A soft deleted product with the name is restored
+	UpsertByName(ctx context.Context, product model.Product) (model.Product, bool, error)
+	// BatchCreate stores multiple products in a single transaction and returns the result of
+	// each of them. When atomic is set a failed product rolls back the whole batch, otherwise
+	// only the failed products are skipped
+	BatchCreate(ctx context.Context, products []model.Product, atomic bool) ([]BatchResult, error)
+	// BatchUpsert updates the products that have an id and creates the others in a single
+	// transaction, a failed product is skipped without affecting the others
+	BatchUpsert(ctx context.Context, products []model.Product) ([]BatchResult, error)
+	// ProductHistory returns the audit entries of the product, the latest first. Every change
+	// is recorded by the transaction of the change with the actor carried by its context
+	ProductHistory(ctx context.Context, productID int, opts HistoryOptions) (HistoryResult, error)
+	// GetAsOf returns the product as it was at asOf according to its history, a product deleted
+	// at the time is returned with its deletion time. ErrNotFound is returned when the product
+	// didn't exist at the time and ErrVersionNotFound when the history has no such version
+	GetAsOf(ctx context.Context, id int, asOf AsOf) (model.Product, error)
+	// Revert restores the name, description, category and amount the product had at the version
+	// as a new write and returns the stored product. The product must not be deleted and must
+	// have expectedVersion unless it is 0
+	Revert(ctx context.Context, id int, version int, expectedVersion int) (model.Product, error)
+}
+
+// BatchResult represents the outcome of a single product of a batch
+type BatchResult struct {
+	Product model.Product
+	// Created reports whether the product was created rather than updated
+	Created bool
+	Err     error
+}
+
+// ListOptions represents filtering, sorting and limit of products listing
+type ListOptions struct {
+	Filter     model.ProductFilter
+	SortBy     model.SortField
+	Descending bool
+	// Limit is the maximum number of returned products, 0 means no limit
+	Limit int
+	// After skips every product up to and including the given one in the sort order
+	After *model.Product
+}
+
+// ListResult represents the listed products
+type ListResult struct {
+	Products []model.Product
+	// HasMore reports whether more products follow the returned ones
+	HasMore bool
+	// TotalCount is the number of products matching the filter, regardless of the limit
+	TotalCount int
+}
+
+// abortBatch marks every result of the batch except the failed one as aborted
+func abortBatch(results []BatchResult, failed int) []BatchResult {
+	for i := range results {
+		if i != failed {
+			results[i] = BatchResult{Err: ErrBatchAborted}
+		}
+	}
+	return results
+}
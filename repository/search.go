@@ -0,0 +1,189 @@
+package repository
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/nadirbasalamah/go-simple-grpc/model"
+)
+
+const (
+	// highlightLength is the number of characters kept around the first match of a highlight
+	highlightLength = 160
+	// highlightContext is the number of characters kept before the first match of a highlight
+	highlightContext = 40
+)
+
+// SearchOptions represents a keyword search of products
+type SearchOptions struct {
+	// Query contains the keywords that every found product must match
+	Query string
+	// Category restricts the hits to a single category, the facets still count every category
+	Category string
+	Limit    int
+	Offset   int
+}
+
+// SearchHit represents a product found by a search
+type SearchHit struct {
+	Product model.Product
+	// Rank orders the hits, higher is more relevant
+	Rank float64
+	// Highlight is a snippet of the name and description with the matches wrapped in <b></b>
+	Highlight string
+}
+
+// CategoryFacet represents the number of products of a category that match a search
+type CategoryFacet struct {
+	Category string
+	Count    int
+}
+
+// SearchResult represents the found products ordered by relevance
+type SearchResult struct {
+	Hits []SearchHit
+	// Facets counts the matching products of every category, the most frequent first
+	Facets []CategoryFacet
+	// HasMore reports whether more hits follow the returned ones
+	HasMore bool
+	// TotalCount is the number of hits, regardless of the limit
+	TotalCount int
+}
+
+// searchTerms returns the lower case keywords of the search query
+func searchTerms(query string) []string {
+	return strings.Fields(strings.ToLower(query))
+}
+
+// substringSearch searches the products by substrings of the keywords, it is used by the
+// storages without full-text search. A keyword found in the name weighs more than in the
+// description, which weighs more than in the category
+func substringSearch(products []model.Product, opts SearchOptions) SearchResult {
+	terms := searchTerms(opts.Query)
+	hits := []SearchHit{}
+	counts := map[string]int{}
+	for _, product := range products {
+		rank, ok := substringRank(product, terms)
+		if !ok {
+			continue
+		}
+		counts[product.Category]++
+		if opts.Category != "" && product.Category != opts.Category {
+			continue
+		}
+		hits = append(hits, SearchHit{Product: product, Rank: rank})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Rank != hits[j].Rank {
+			return hits[i].Rank > hits[j].Rank
+		}
+		return hits[i].Product.ID < hits[j].Product.ID
+	})
+
+	result := SearchResult{Facets: facets(counts), TotalCount: len(hits)}
+	if opts.Offset >= len(hits) {
+		result.Hits = []SearchHit{}
+		return result
+	}
+	hits = hits[opts.Offset:]
+	if opts.Limit > 0 && len(hits) > opts.Limit {
+		hits = hits[:opts.Limit]
+		result.HasMore = true
+	}
+	for i := range hits {
+		hits[i].Highlight = highlight(strings.TrimSpace(hits[i].Product.Name+" "+hits[i].Product.Description), terms)
+	}
+	result.Hits = hits
+	return result
+}
+
+// substringRank returns the rank of the product and whether every term is found in it
+func substringRank(product model.Product, terms []string) (float64, bool) {
+	name := strings.ToLower(product.Name)
+	description := strings.ToLower(product.Description)
+	category := strings.ToLower(product.Category)
+
+	rank := 0.0
+	for _, term := range terms {
+		found := false
+		if strings.Contains(name, term) {
+			rank, found = rank+1, true
+		}
+		if strings.Contains(description, term) {
+			rank, found = rank+0.4, true
+		}
+		if strings.Contains(category, term) {
+			rank, found = rank+0.2, true
+		}
+		if !found {
+			return 0, false
+		}
+	}
+	return rank, len(terms) > 0
+}
+
+// facets returns the category counts, the most frequent first
+func facets(counts map[string]int) []CategoryFacet {
+	result := []CategoryFacet{}
+	for category, count := range counts {
+		result = append(result, CategoryFacet{Category: category, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Category < result[j].Category
+	})
+	return result
+}
+
+// highlight wraps the terms found in text in <b></b>, a long text is cut around the first match
+func highlight(text string, terms []string) string {
+	runes := []rune(text)
+	// strings.ToLower maps every rune to a single rune so the indexes of both match
+	lower := []rune(strings.ToLower(text))
+	marked := make([]bool, len(runes))
+	first := -1
+	for _, term := range terms {
+		t := []rune(term)
+		for i := 0; i+len(t) <= len(lower); i++ {
+			if string(lower[i:i+len(t)]) != term {
+				continue
+			}
+			for j := i; j < i+len(t); j++ {
+				marked[j] = true
+			}
+			if first < 0 || i < first {
+				first = i
+			}
+		}
+	}
+
+	start, end := 0, len(runes)
+	if end > highlightLength {
+		if first > highlightContext {
+			start = first - highlightContext
+		}
+		if start+highlightLength < end {
+			end = start + highlightLength
+		}
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("...")
+	}
+	for i := start; i < end; i++ {
+		if marked[i] && (i == start || !marked[i-1]) {
+			b.WriteString("<b>")
+		}
+		b.WriteRune(runes[i])
+		if marked[i] && (i == end-1 || !marked[i+1]) {
+			b.WriteString("</b>")
+		}
+	}
+	if end < len(runes) {
+		b.WriteString("...")
+	}
+	return b.String()
+}
@@ -0,0 +1,492 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nadirbasalamah/go-simple-grpc/model"
+)
+
+// dialect represents the differences between the supported SQL databases
+type dialect interface {
+	// rebind converts the ? placeholders in query into the bind variables of the database
+	rebind(query string) string
+	// translate converts the driver errors it knows into repository errors
+	translate(err error) error
+	// search runs the keyword search with the text search features of the database
+	search(ctx context.Context, q querier, opts SearchOptions) (SearchResult, error)
+	// forUpdate returns the clause locking the selected rows until the end of the transaction
+	forUpdate() string
+}
+
+// productColumns lists the product columns in the order expected by scanProduct
+const productColumns = "id, name, description, category, amount, version, deleted_at"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanProduct scans the product columns followed by the extra columns of the row
+func scanProduct(row scanner, extra ...interface{}) (model.Product, error) {
+	product := model.Product{}
+	deletedAt := sql.NullTime{}
+	dest := []interface{}{&product.ID, &product.Name, &product.Description, &product.Category, &product.Amount, &product.Version, &deletedAt}
+	err := row.Scan(append(dest, extra...)...)
+	if deletedAt.Valid {
+		product.DeletedAt = &deletedAt.Time
+	}
+	return product, err
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// SQLRepository represents product repository backed by a SQL database
+type SQLRepository struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+// Create stores a new product and returns the stored row
+func (r *SQLRepository) Create(ctx context.Context, product model.Product) (model.Product, error) {
+	var created model.Product
+	err := r.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		created, err = r.create(ctx, tx, product)
+		return err
+	})
+	return created, err
+}
+
+// create inserts the product and records the change with q, which must be a transaction
+func (r *SQLRepository) create(ctx context.Context, q querier, product model.Product) (model.Product, error) {
+	row := q.QueryRowContext(ctx, r.dialect.rebind("INSERT INTO products (name, description, category, amount) VALUES (?, ?, ?, ?) RETURNING "+productColumns), product.Name, product.Description, product.Category, product.Amount)
+	product, err := scanProduct(row)
+	if err != nil {
+		return model.Product{}, r.dialect.translate(err)
+	}
+	return product, r.record(ctx, q, AuditCreated, product)
+}
+
+// inTx runs fn in a transaction that is committed when fn succeeds
+func (r *SQLRepository) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return r.dialect.translate(err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return r.dialect.translate(tx.Commit())
+}
+
+// Get returns specific product by id, soft deleted products are only returned when
+// showDeleted is set
+func (r *SQLRepository) Get(ctx context.Context, id int, showDeleted bool) (model.Product, error) {
+	query := "SELECT " + productColumns + " FROM products WHERE id = ?"
+	if !showDeleted {
+		query += " AND deleted_at IS NULL"
+	}
+
+	row := r.db.QueryRowContext(ctx, r.dialect.rebind(query), id)
+	switch product, err := scanProduct(row); err {
+	case sql.ErrNoRows:
+		return model.Product{}, ErrNotFound
+	case nil:
+		return product, nil
+	default:
+		return model.Product{}, r.dialect.translate(err)
+	}
+}
+
+// Update replaces the given fields of the product with the id, every field when none is
+// given, and returns the stored row
+func (r *SQLRepository) Update(ctx context.Context, id int, product model.Product, fields []string) (model.Product, error) {
+	var updated model.Product
+	err := r.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		updated, err = r.update(ctx, tx, id, product, fields)
+		return err
+	})
+	return updated, err
+}
+
+// update changes the product and records the change with q, which must be a transaction
+func (r *SQLRepository) update(ctx context.Context, q querier, id int, product model.Product, fields []string) (model.Product, error) {
+	if len(fields) == 0 {
+		fields = model.ProductFields
+	}
+
+	assignments := []string{}
+	args := []interface{}{}
+	for _, field := range fields {
+		assignments = append(assignments, field+"=?")
+		args = append(args, product.FieldValue(field))
+	}
+	assignments = append(assignments, "version=version+1")
+
+	condition, conditionArgs := versionCondition(id, product.Version)
+	args = append(args, conditionArgs...)
+
+	row := q.QueryRowContext(ctx, r.dialect.rebind("UPDATE products SET "+strings.Join(assignments, ", ")+" WHERE "+condition+" RETURNING "+productColumns), args...)
+	switch updatedProduct, err := scanProduct(row); err {
+	case sql.ErrNoRows:
+		return model.Product{}, r.missingError(ctx, q, id)
+	case nil:
+		return updatedProduct, r.record(ctx, q, AuditUpdated, updatedProduct)
+	default:
+		return model.Product{}, r.dialect.translate(err)
+	}
+}
+
+// Delete soft deletes the product data with the given id
+func (r *SQLRepository) Delete(ctx context.Context, id int, expectedVersion int) (model.Product, error) {
+	condition, conditionArgs := versionCondition(id, expectedVersion)
+	args := append([]interface{}{time.Now().UTC()}, conditionArgs...)
+
+	var deleted model.Product
+	err := r.inTx(ctx, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, r.dialect.rebind("UPDATE products SET deleted_at=?, version=version+1 WHERE "+condition+" RETURNING "+productColumns), args...)
+		var err error
+		switch deleted, err = scanProduct(row); err {
+		case sql.ErrNoRows:
+			return r.missingError(ctx, tx, id)
+		case nil:
+			return r.record(ctx, tx, AuditDeleted, deleted)
+		default:
+			return r.dialect.translate(err)
+		}
+	})
+	if err != nil {
+		return model.Product{}, err
+	}
+	return deleted, nil
+}
+
+// Undelete restores the soft deleted product with the given id
+func (r *SQLRepository) Undelete(ctx context.Context, id int) (model.Product, error) {
+	var restored model.Product
+	err := r.inTx(ctx, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, r.dialect.rebind("UPDATE products SET deleted_at=NULL, version=version+1 WHERE id = ? AND deleted_at IS NOT NULL RETURNING "+productColumns), id)
+		var err error
+		switch restored, err = scanProduct(row); err {
+		case sql.ErrNoRows:
+			if err := r.missingError(ctx, tx, id); err != ErrVersionMismatch {
+				return err
+			}
+			// the product exists and isn't deleted
+			return ErrNotDeleted
+		case nil:
+			return r.record(ctx, tx, AuditRestored, restored)
+		default:
+			return r.dialect.translate(err)
+		}
+	})
+	if err != nil {
+		return model.Product{}, err
+	}
+	return restored, nil
+}
+
+// PurgeDeleted permanently removes the products deleted before the given time
+func (r *SQLRepository) PurgeDeleted(ctx context.Context, deletedBefore time.Time) (int, error) {
+	purged := 0
+	err := r.inTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, r.dialect.rebind("DELETE FROM products WHERE deleted_at IS NOT NULL AND deleted_at < ? RETURNING "+productColumns), deletedBefore.UTC())
+		if err != nil {
+			return r.dialect.translate(err)
+		}
+
+		// the rows are read before recording the changes, a connection runs a
+		// single statement at a time
+		products := []model.Product{}
+		for rows.Next() {
+			product, err := scanProduct(rows)
+			if err != nil {
+				rows.Close()
+				return r.dialect.translate(err)
+			}
+			products = append(products, product)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return r.dialect.translate(err)
+		}
+
+		for _, product := range products {
+			if err := r.record(ctx, tx, AuditPurged, product); err != nil {
+				return err
+			}
+		}
+		purged = len(products)
+		return nil
+	})
+	return purged, err
+}
+
+// versionCondition returns the WHERE condition matching the product id when it is not
+// deleted, and its version when expectedVersion is set
+func versionCondition(id int, expectedVersion int) (string, []interface{}) {
+	if expectedVersion == 0 {
+		return "id = ? AND deleted_at IS NULL", []interface{}{id}
+	}
+	return "id = ? AND deleted_at IS NULL AND version = ?", []interface{}{id, expectedVersion}
+}
+
+// missingError tells apart a missing product from a version mismatch after a write
+// matched no row
+func (r *SQLRepository) missingError(ctx context.Context, q querier, id int) error {
+	var exists int
+	err := q.QueryRowContext(ctx, r.dialect.rebind("SELECT 1 FROM products WHERE id = ? AND deleted_at IS NULL"), id).Scan(&exists)
+	switch err {
+	case sql.ErrNoRows:
+		return ErrNotFound
+	case nil:
+		return ErrVersionMismatch
+	default:
+		return r.dialect.translate(err)
+	}
+}
+
+// sortColumns maps the sort fields to the product columns
+var sortColumns = map[model.SortField]string{
+	model.SortByName:   "name",
+	model.SortByID:     "id",
+	model.SortByAmount: "amount",
+}
+
+// List returns the products matching the options in the requested order
+func (r *SQLRepository) List(ctx context.Context, opts ListOptions) (ListResult, error) {
+	conditions, args := filterConditions(opts.Filter)
+
+	result := ListResult{Products: []model.Product{}}
+	countQuery := "SELECT COUNT(*) FROM products"
+	if len(conditions) > 0 {
+		countQuery += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	if err := r.db.QueryRowContext(ctx, r.dialect.rebind(countQuery), args...).Scan(&result.TotalCount); err != nil {
+		return ListResult{}, r.dialect.translate(err)
+	}
+
+	column := sortColumns[opts.SortBy]
+	direction, op := "ASC", ">"
+	if opts.Descending {
+		direction, op = "DESC", "<"
+	}
+
+	// keyset pagination, id breaks the ties of the sort column
+	if opts.After != nil {
+		if opts.SortBy == model.SortByID {
+			conditions = append(conditions, "id "+op+" ?")
+			args = append(args, opts.After.ID)
+		} else {
+			value := sortValue(*opts.After, opts.SortBy)
+			conditions = append(conditions, fmt.Sprintf("(%s %s ? OR (%s = ? AND id %s ?))", column, op, column, op))
+			args = append(args, value, value, opts.After.ID)
+		}
+	}
+
+	query := "SELECT " + productColumns + " FROM products"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s", column, direction)
+	if opts.SortBy != model.SortByID {
+		query += ", id " + direction
+	}
+	if opts.Limit > 0 {
+		// fetch one more row to know whether another page follows
+		query += " LIMIT ?"
+		args = append(args, opts.Limit+1)
+	}
+
+	rows, err := r.db.QueryContext(ctx, r.dialect.rebind(query), args...)
+	if err != nil {
+		return ListResult{}, r.dialect.translate(err)
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			return ListResult{}, r.dialect.translate(err)
+		}
+		result.Products = append(result.Products, product)
+	}
+	if err := rows.Err(); err != nil {
+		return ListResult{}, r.dialect.translate(err)
+	}
+
+	if opts.Limit > 0 && len(result.Products) > opts.Limit {
+		result.Products = result.Products[:opts.Limit]
+		result.HasMore = true
+	}
+	return result, nil
+}
+
+// Search returns the products matching the keywords of the options, the most relevant first
+func (r *SQLRepository) Search(ctx context.Context, opts SearchOptions) (SearchResult, error) {
+	result, err := r.dialect.search(ctx, r.db, opts)
+	return result, r.dialect.translate(err)
+}
+
+// filterConditions returns the WHERE conditions and their arguments for the filter
+func filterConditions(filter model.ProductFilter) ([]string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+
+	if !filter.ShowDeleted {
+		conditions = append(conditions, "deleted_at IS NULL")
+	}
+
+	if filter.Category != "" {
+		conditions = append(conditions, "category = ?")
+		args = append(args, filter.Category)
+	}
+	if filter.NamePrefix != "" {
+		conditions = append(conditions, `lower(name) LIKE ? ESCAPE '\'`)
+		args = append(args, escapeLike(strings.ToLower(filter.NamePrefix))+"%")
+	}
+	if filter.MinAmount != nil {
+		conditions = append(conditions, "amount >= ?")
+		args = append(args, *filter.MinAmount)
+	}
+	if filter.MaxAmount != nil {
+		conditions = append(conditions, "amount <= ?")
+		args = append(args, *filter.MaxAmount)
+	}
+	return conditions, args
+}
+
+// escapeLike escapes the LIKE wildcards of s
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// sortValue returns the value of the sort field of the product
+func sortValue(product model.Product, field model.SortField) interface{} {
+	switch field {
+	case model.SortByAmount:
+		return product.Amount
+	case model.SortByID:
+		return product.ID
+	default:
+		return product.Name
+	}
+}
+
+// UpsertByName inserts the product or updates the row with the same name in a single
+// statement, a new row is the only one with version 1
+func (r *SQLRepository) UpsertByName(ctx context.Context, product model.Product) (model.Product, bool, error) {
+	var upserted model.Product
+	err := r.inTx(ctx, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, r.dialect.rebind(`INSERT INTO products (name, description, category, amount) VALUES (?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET description=excluded.description, category=excluded.category, amount=excluded.amount,
+		version=products.version+1, deleted_at=NULL
+		RETURNING `+productColumns), product.Name, product.Description, product.Category, product.Amount)
+		var err error
+		if upserted, err = scanProduct(row); err != nil {
+			return r.dialect.translate(err)
+		}
+
+		action := AuditUpdated
+		if upserted.Version == 1 {
+			action = AuditCreated
+		}
+		return r.record(ctx, tx, action, upserted)
+	})
+	if err != nil {
+		return model.Product{}, false, err
+	}
+	return upserted, upserted.Version == 1, nil
+}
+
+// BatchCreate stores multiple products in a single transaction, in best-effort mode every
+// product runs in its own savepoint so a failure doesn't abort the transaction
+func (r *SQLRepository) BatchCreate(ctx context.Context, products []model.Product, atomic bool) ([]BatchResult, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, r.dialect.translate(err)
+	}
+	defer tx.Rollback()
+
+	results := make([]BatchResult, len(products))
+	for i, product := range products {
+		if atomic {
+			results[i].Product, results[i].Err = r.create(ctx, tx, product)
+			results[i].Created = results[i].Err == nil
+			if results[i].Err != nil {
+				return abortBatch(results, i), nil
+			}
+			continue
+		}
+
+		err := savepoint(ctx, tx, func() error {
+			results[i].Product, results[i].Err = r.create(ctx, tx, product)
+			results[i].Created = results[i].Err == nil
+			return results[i].Err
+		})
+		if err != nil {
+			return nil, r.dialect.translate(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, r.dialect.translate(err)
+	}
+	return results, nil
+}
+
+// BatchUpsert updates the products that have an id and creates the others in a single
+// transaction, every product runs in its own savepoint
+func (r *SQLRepository) BatchUpsert(ctx context.Context, products []model.Product) ([]BatchResult, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, r.dialect.translate(err)
+	}
+	defer tx.Rollback()
+
+	results := make([]BatchResult, len(products))
+	for i, product := range products {
+		err := savepoint(ctx, tx, func() error {
+			if product.ID == 0 {
+				results[i].Product, results[i].Err = r.create(ctx, tx, product)
+				results[i].Created = results[i].Err == nil
+			} else {
+				results[i].Product, results[i].Err = r.update(ctx, tx, product.ID, product, nil)
+			}
+			return results[i].Err
+		})
+		if err != nil {
+			return nil, r.dialect.translate(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, r.dialect.translate(err)
+	}
+	return results, nil
+}
+
+// savepoint runs fn in a savepoint of the transaction and rolls back to it when fn fails,
+// only the errors of the savepoint statements are returned
+func savepoint(ctx context.Context, tx *sql.Tx, fn func() error) error {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT batch_item"); err != nil {
+		return err
+	}
+	release := "RELEASE SAVEPOINT batch_item"
+	if fn() != nil {
+		release = "ROLLBACK TO SAVEPOINT batch_item"
+	}
+	_, err := tx.ExecContext(ctx, release)
+	return err
+}
@@ -0,0 +1,488 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nadirbasalamah/go-simple-grpc/migration"
+	"github.com/nadirbasalamah/go-simple-grpc/model"
+)
+
+func newTestSQLiteRepository(t *testing.T) *SQLRepository {
+	t.Helper()
+	db, m := newTestSQLiteDB(t)
+	if err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return NewSQLiteRepository(db)
+}
+
+// newTestSQLiteDB returns an empty in-memory database and its migrator
+func newTestSQLiteDB(t *testing.T) (*sql.DB, *migration.Migrator) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: opens a new database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	m, err := migration.New(db, "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, m
+}
+
+func TestSQLRepositoryUpdate(t *testing.T) {
+	ctx := context.Background()
+	r := newTestSQLiteRepository(t)
+
+	created, err := r.Create(ctx, model.Product{Name: "Sample product", Category: "Gadget", Amount: 100})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	updated, err := r.Update(ctx, created.ID, model.Product{Name: "Edited product", Category: "Books", Amount: 10}, nil)
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	want := model.Product{ID: created.ID, Name: "Edited product", Category: "Books", Amount: 10, Version: 2}
+	if updated != want {
+		t.Errorf("Update() = %+v, want %+v", updated, want)
+	}
+
+	stale := want
+	stale.Version = 1
+	if _, err := r.Update(ctx, created.ID, stale, nil); err != ErrVersionMismatch {
+		t.Errorf("Update() with stale version error = %v, want %v", err, ErrVersionMismatch)
+	}
+
+	if _, err := r.Update(ctx, created.ID+1, want, nil); err != ErrNotFound {
+		t.Errorf("Update() of missing id error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestSQLRepositoryDelete(t *testing.T) {
+	ctx := context.Background()
+	r := newTestSQLiteRepository(t)
+
+	created, err := r.Create(ctx, model.Product{Name: "Sample product", Category: "Gadget", Amount: 100})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	if _, err := r.Delete(ctx, created.ID, 0); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := r.Delete(ctx, created.ID, 0); err != ErrNotFound {
+		t.Errorf("Delete() of deleted id error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestSQLRepositorySoftDelete(t *testing.T) {
+	ctx := context.Background()
+	r := newTestSQLiteRepository(t)
+
+	created, err := r.Create(ctx, model.Product{Name: "Sample product", Category: "Gadget", Amount: 100})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := r.Delete(ctx, created.ID, 0); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	if _, err := r.Get(ctx, created.ID, false); err != ErrNotFound {
+		t.Errorf("Get() of deleted product error = %v, want %v", err, ErrNotFound)
+	}
+	deleted, err := r.Get(ctx, created.ID, true)
+	if err != nil || deleted.DeletedAt == nil {
+		t.Errorf("Get() with show deleted = %+v, %v, want deleted product", deleted, err)
+	}
+	if _, err := r.Update(ctx, created.ID, created, nil); err != ErrNotFound {
+		t.Errorf("Update() of deleted product error = %v, want %v", err, ErrNotFound)
+	}
+
+	if purged, err := r.PurgeDeleted(ctx, time.Now().Add(time.Minute)); err != nil || purged != 1 {
+		t.Errorf("PurgeDeleted() = %d, %v, want 1, nil", purged, err)
+	}
+	if _, err := r.Undelete(ctx, created.ID); err != ErrNotFound {
+		t.Errorf("Undelete() of purged product error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestSQLRepositoryDuplicateName(t *testing.T) {
+	ctx := context.Background()
+	r := newTestSQLiteRepository(t)
+
+	product := model.Product{Name: "Sample product", Category: "Gadget", Amount: 100}
+	if _, err := r.Create(ctx, product); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	_, err := r.Create(ctx, product)
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("Create() of duplicate name error = %v, want %v", err, ErrAlreadyExists)
+	}
+	var dbErr *Error
+	if !errors.As(err, &dbErr) || dbErr.Kind != Duplicate || dbErr.Column != "name" {
+		t.Errorf("Create() of duplicate name error = %#v, want Duplicate error of column name", err)
+	}
+}
+
+func TestSQLRepositoryIdempotencyKeys(t *testing.T) {
+	ctx := context.Background()
+	r := newTestSQLiteRepository(t)
+
+	record := IdempotencyRecord{Key: "CreateProduct/key", RequestHash: "hash", ExpiresAt: time.Now().Add(time.Hour)}
+	if _, reserved, err := r.Reserve(ctx, record); err != nil || !reserved {
+		t.Fatalf("Reserve() = %v, %v, want reserved", reserved, err)
+	}
+	if err := r.Release(ctx, record.Key); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	if _, reserved, err := r.Reserve(ctx, record); err != nil || !reserved {
+		t.Fatalf("Reserve() after release = %v, %v, want reserved", reserved, err)
+	}
+
+	if err := r.Complete(ctx, record.Key, []byte(`{"ID":1}`), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Complete() error = %v", err)
+	}
+	stored, reserved, err := r.Reserve(ctx, record)
+	if err != nil || reserved {
+		t.Fatalf("Reserve() of used key = %v, %v, want not reserved", reserved, err)
+	}
+	if stored.RequestHash != "hash" || string(stored.Response) != `{"ID":1}` {
+		t.Errorf("Reserve() of used key = %+v", stored)
+	}
+
+	expired := IdempotencyRecord{Key: "CreateProduct/expired", RequestHash: "hash", ExpiresAt: time.Now().Add(-time.Second)}
+	if _, _, err := r.Reserve(ctx, expired); err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	if _, reserved, err := r.Reserve(ctx, expired); err != nil || !reserved {
+		t.Errorf("Reserve() of expired key = %v, %v, want reserved", reserved, err)
+	}
+	// completing keeps the key after the reservation ended
+	if err := r.Complete(ctx, expired.Key, []byte(`{"ID":2}`), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Complete() error = %v", err)
+	}
+	if _, reserved, err := r.Reserve(ctx, expired); err != nil || reserved {
+		t.Errorf("Reserve() of completed key = %v, %v, want not reserved", reserved, err)
+	}
+}
+
+func TestSQLRepositoryUpsertByName(t *testing.T) {
+	ctx := context.Background()
+	r := newTestSQLiteRepository(t)
+
+	created, isNew, err := r.UpsertByName(ctx, model.Product{Name: "Sample product", Category: "Gadget", Amount: 100})
+	if err != nil || !isNew {
+		t.Fatalf("UpsertByName() = %v, %v, want created", isNew, err)
+	}
+	if _, err := r.Delete(ctx, created.ID, 0); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	updated, isNew, err := r.UpsertByName(ctx, model.Product{Name: "Sample product", Category: "Books", Amount: 5})
+	if err != nil || isNew {
+		t.Fatalf("UpsertByName() of existing name = %v, %v, want updated", isNew, err)
+	}
+	want := model.Product{ID: created.ID, Name: "Sample product", Category: "Books", Amount: 5, Version: 3}
+	if updated != want {
+		t.Errorf("UpsertByName() = %+v, want %+v", updated, want)
+	}
+}
+
+func TestSQLRepositorySearch(t *testing.T) {
+	ctx := context.Background()
+	r := newTestSQLiteRepository(t)
+
+	products := []model.Product{
+		{Name: "Wireless mouse", Description: "A quiet mouse", Category: "Gadget", Amount: 10},
+		{Name: "Mouse pad", Description: "Large desk pad", Category: "Office", Amount: 10},
+		{Name: "Keyboard", Description: "Works with any wireless mouse", Category: "Gadget", Amount: 10},
+		{Name: "Cat toy", Description: "Shaped like a mouse", Category: "Pets", Amount: 10},
+	}
+	for _, product := range products {
+		if _, err := r.Create(ctx, product); err != nil {
+			t.Fatalf("Create() error = %v", err)
+		}
+	}
+
+	result, err := r.Search(ctx, SearchOptions{Query: "Wireless MOUSE", Limit: 1})
+	if err != nil {
+		t.Fatalf("Search() error = %v", err)
+	}
+	if result.TotalCount != 2 || !result.HasMore || len(result.Hits) != 1 {
+		t.Fatalf("Search() = %+v, want 1 of 2 hits", result)
+	}
+	if hit := result.Hits[0]; hit.Product.Name != "Wireless mouse" || hit.Highlight != "<b>Wireless</b> <b>mouse</b> A quiet <b>mouse</b>" {
+		t.Errorf("Search() first hit = %+v", hit)
+	}
+
+	result, err = r.Search(ctx, SearchOptions{Query: "mouse", Category: "Office"})
+	if err != nil {
+		t.Fatalf("Search() error = %v", err)
+	}
+	wantFacets := []CategoryFacet{{"Gadget", 2}, {"Office", 1}, {"Pets", 1}}
+	if result.TotalCount != 1 || !reflect.DeepEqual(result.Facets, wantFacets) {
+		t.Errorf("Search() in category = %+v, want 1 hit and facets %v", result, wantFacets)
+	}
+}
+
+func TestSQLRepositoryOutbox(t *testing.T) {
+	ctx := context.Background()
+	r := newTestSQLiteRepository(t)
+
+	created, err := r.Create(ctx, model.Product{Name: "Sample product", Category: "Gadget", Amount: 100})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	// failed writes leave no message behind
+	if _, err := r.Create(ctx, model.Product{Name: "Sample product", Category: "Gadget", Amount: 100}); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Create() of duplicate name error = %v, want %v", err, ErrAlreadyExists)
+	}
+	if _, err := r.BatchCreate(ctx, []model.Product{{Name: "Other product"}, {Name: "Sample product"}}, true); err != nil {
+		t.Fatalf("BatchCreate() error = %v", err)
+	}
+	if _, err := r.Delete(ctx, created.ID, 0); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := r.PurgeDeleted(ctx, time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("PurgeDeleted() error = %v", err)
+	}
+
+	messages, err := r.ClaimOutbox(ctx, "first", 10, time.Minute)
+	if err != nil {
+		t.Fatalf("ClaimOutbox() error = %v", err)
+	}
+	types := []string{}
+	for _, message := range messages {
+		event := OutboxEvent{}
+		if err := json.Unmarshal(message.Payload, &event); err != nil {
+			t.Fatalf("json.Unmarshal() of message %d error = %v", message.ID, err)
+		}
+		if event.Product.ID != created.ID {
+			t.Errorf("message %d product = %d, want %d", message.ID, event.Product.ID, created.ID)
+		}
+		types = append(types, event.Type)
+	}
+	if want := []string{OutboxCreated, OutboxDeleted, OutboxPurged}; !reflect.DeepEqual(types, want) {
+		t.Fatalf("ClaimOutbox() events = %v, want %v", types, want)
+	}
+
+	// the claimed messages are held back from other claimers until they are released
+	if claimed, err := r.ClaimOutbox(ctx, "second", 10, time.Minute); len(claimed) != 0 || err != nil {
+		t.Errorf("ClaimOutbox() of claimed messages = %+v, %v, want no message", claimed, err)
+	}
+	if err := r.MarkOutboxDelivered(ctx, "second", messages[1].ID); err != ErrClaimLost {
+		t.Errorf("MarkOutboxDelivered() by other claimer error = %v, want %v", err, ErrClaimLost)
+	}
+
+	retryAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	if err := r.MarkOutboxFailed(ctx, "first", messages[0].ID, retryAt, "unreachable"); err != nil {
+		t.Fatalf("MarkOutboxFailed() error = %v", err)
+	}
+	if err := r.MarkOutboxDelivered(ctx, "first", messages[1].ID); err != nil {
+		t.Fatalf("MarkOutboxDelivered() error = %v", err)
+	}
+	if err := r.ReleaseOutbox(ctx, "first"); err != nil {
+		t.Fatalf("ReleaseOutbox() error = %v", err)
+	}
+
+	pending, err := r.ClaimOutbox(ctx, "second", 10, time.Minute)
+	if err != nil {
+		t.Fatalf("ClaimOutbox() of released messages error = %v", err)
+	}
+	if len(pending) != 2 {
+		t.Fatalf("ClaimOutbox() of released messages = %+v, want 2 messages", pending)
+	}
+	want := messages[0]
+	want.Attempts, want.NextAttemptAt, want.LastError = 1, retryAt, "unreachable"
+	if got := pending[0]; got.ID != want.ID || got.Attempts != want.Attempts || !got.NextAttemptAt.Equal(want.NextAttemptAt) || got.LastError != want.LastError {
+		t.Errorf("ClaimOutbox() of failed message = %+v, want %+v", got, want)
+	}
+
+	if purged, err := r.PurgeDelivered(ctx, time.Now().Add(time.Minute)); purged != 1 || err != nil {
+		t.Errorf("PurgeDelivered() = %d, %v, want 1, nil", purged, err)
+	}
+}
+
+func TestSQLRepositoryProductHistory(t *testing.T) {
+	ctx := WithActor(context.Background(), Actor{Identity: "alice", Peer: "127.0.0.1:5000"})
+	r := newTestSQLiteRepository(t)
+
+	created, err := r.Create(ctx, model.Product{Name: "Sample product", Category: "Gadget", Amount: 100})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := r.Update(ctx, created.ID, model.Product{Amount: 80}, []string{"amount"}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	// a failed write records nothing
+	if _, err := r.Update(ctx, created.ID, model.Product{Version: 1, Amount: 60}, []string{"amount"}); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Update() with stale version error = %v, want %v", err, ErrVersionMismatch)
+	}
+
+	result, err := r.ProductHistory(ctx, created.ID, HistoryOptions{Limit: 1})
+	if err != nil {
+		t.Fatalf("ProductHistory() error = %v", err)
+	}
+	if len(result.Entries) != 1 || !result.HasMore {
+		t.Fatalf("ProductHistory() = %+v, want 1 entry and more", result)
+	}
+	update := result.Entries[0]
+	wantProduct := created
+	wantProduct.Amount, wantProduct.Version = 80, 2
+	if update.Action != AuditUpdated || update.Actor != (Actor{Identity: "alice", Peer: "127.0.0.1:5000"}) || update.Product != wantProduct {
+		t.Errorf("ProductHistory() entry = %+v, want the update by alice to %+v", update, wantProduct)
+	}
+	if want := []FieldChange{{Field: "amount", Before: "100", After: "80"}}; !reflect.DeepEqual(update.Changes, want) {
+		t.Errorf("ProductHistory() changes = %+v, want %+v", update.Changes, want)
+	}
+
+	result, err = r.ProductHistory(ctx, created.ID, HistoryOptions{BeforeID: update.ID})
+	if err != nil {
+		t.Fatalf("ProductHistory() before the update error = %v", err)
+	}
+	if len(result.Entries) != 1 || result.HasMore {
+		t.Fatalf("ProductHistory() before the update = %+v, want 1 entry", result)
+	}
+	if create := result.Entries[0]; create.Action != AuditCreated || len(create.Changes) != 3 {
+		t.Errorf("ProductHistory() before the update = %+v, want the create with 3 changes", create)
+	}
+}
+
+func TestSQLRepositoryAuditBaseline(t *testing.T) {
+	ctx := context.Background()
+	db, m := newTestSQLiteDB(t)
+	// products written before the audit log
+	if err := m.To(ctx, 7); err != nil {
+		t.Fatalf("To() error = %v", err)
+	}
+	deletedAt := time.Now().UTC()
+	if _, err := db.ExecContext(ctx, "INSERT INTO products (name, description, category, amount, version, deleted_at) VALUES (?, ?, ?, ?, ?, NULL), (?, ?, ?, ?, ?, ?)",
+		"Legacy product", "Written before the audit log", "Gadget", 100, 3,
+		"Deleted legacy product", "", "Books", 5, 2, deletedAt); err != nil {
+		t.Fatalf("ExecContext() error = %v", err)
+	}
+	if err := m.Up(ctx); err != nil {
+		t.Fatalf("Up() error = %v", err)
+	}
+	r := NewSQLiteRepository(db)
+
+	legacy, err := r.Get(ctx, 1, false)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if _, err := r.Update(ctx, legacy.ID, model.Product{Amount: 80}, []string{"amount"}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	result, err := r.ProductHistory(ctx, legacy.ID, HistoryOptions{})
+	if err != nil {
+		t.Fatalf("ProductHistory() error = %v", err)
+	}
+	if len(result.Entries) != 2 {
+		t.Fatalf("ProductHistory() = %+v, want the update and the baseline", result)
+	}
+	if baseline := result.Entries[1]; baseline.Action != AuditBaseline || baseline.Product != legacy || len(baseline.Changes) != 0 {
+		t.Errorf("ProductHistory() baseline = %+v, want %+v without changes", baseline, legacy)
+	}
+	if want := []FieldChange{{Field: "amount", Before: "100", After: "80"}}; !reflect.DeepEqual(result.Entries[0].Changes, want) {
+		t.Errorf("ProductHistory() changes = %+v, want %+v", result.Entries[0].Changes, want)
+	}
+
+	// the baseline holds the state from before the audit log
+	old, err := r.GetAsOf(ctx, legacy.ID, AsOf{Time: time.Now().Add(-24 * time.Hour)})
+	if err != nil {
+		t.Fatalf("GetAsOf() before the audit log error = %v", err)
+	}
+	if old != legacy {
+		t.Errorf("GetAsOf() before the audit log = %+v, want %+v", old, legacy)
+	}
+	reverted, err := r.Revert(ctx, legacy.ID, legacy.Version, 0)
+	if err != nil {
+		t.Fatalf("Revert() to baseline version error = %v", err)
+	}
+	if reverted.Amount != legacy.Amount || reverted.Version != legacy.Version+2 {
+		t.Errorf("Revert() to baseline version = %+v, want amount %d at version %d", reverted, legacy.Amount, legacy.Version+2)
+	}
+	if _, err := r.GetAsOf(ctx, legacy.ID, AsOf{Version: 1}); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("GetAsOf() of version before the baseline error = %v, want %v", err, ErrVersionNotFound)
+	}
+
+	// the deletion time survives the backfill
+	if _, err := r.Undelete(ctx, 2); err != nil {
+		t.Fatalf("Undelete() error = %v", err)
+	}
+	result, err = r.ProductHistory(ctx, 2, HistoryOptions{Limit: 1})
+	if err != nil {
+		t.Fatalf("ProductHistory() error = %v", err)
+	}
+	if changes := result.Entries[0].Changes; len(changes) != 1 || changes[0].Field != "deleted_at" || changes[0].After != "" {
+		t.Errorf("ProductHistory() changes of restore = %+v, want only deleted_at cleared", changes)
+	}
+}
+
+func TestSQLRepositoryGetAsOfAndRevert(t *testing.T) {
+	ctx := context.Background()
+	r := newTestSQLiteRepository(t)
+
+	created, err := r.Create(ctx, model.Product{Name: "Sample product", Category: "Gadget", Amount: 100})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	beforeEdit := time.Now()
+	if _, err := r.Update(ctx, created.ID, model.Product{Amount: 80}, []string{"amount"}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	old, err := r.GetAsOf(ctx, created.ID, AsOf{Time: beforeEdit})
+	if err != nil {
+		t.Fatalf("GetAsOf() error = %v", err)
+	}
+	if old != created {
+		t.Errorf("GetAsOf() before the edit = %+v, want %+v", old, created)
+	}
+	if _, err := r.GetAsOf(ctx, created.ID, AsOf{Time: beforeEdit.Add(-time.Hour)}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetAsOf() before the create error = %v, want %v", err, ErrNotFound)
+	}
+
+	reverted, err := r.Revert(ctx, created.ID, 1, 2)
+	if err != nil {
+		t.Fatalf("Revert() error = %v", err)
+	}
+	want := created
+	want.Version = 3
+	if reverted != want {
+		t.Errorf("Revert() = %+v, want %+v", reverted, want)
+	}
+	if _, err := r.Revert(ctx, created.ID, 5, 0); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("Revert() to unknown version error = %v, want %v", err, ErrVersionNotFound)
+	}
+
+	if _, err := r.Delete(ctx, created.ID, 0); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := r.PurgeDeleted(ctx, time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("PurgeDeleted() error = %v", err)
+	}
+	if _, err := r.GetAsOf(ctx, created.ID, AsOf{Time: time.Now()}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetAsOf() after the purge error = %v, want %v", err, ErrNotFound)
+	}
+	deleted, err := r.GetAsOf(ctx, created.ID, AsOf{Version: 4})
+	if err != nil {
+		t.Fatalf("GetAsOf() of deleted version error = %v", err)
+	}
+	if deleted.DeletedAt == nil {
+		t.Errorf("GetAsOf() of deleted version = %+v, want a deleted product", deleted)
+	}
+}
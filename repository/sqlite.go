@@ -0,0 +1,97 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/nadirbasalamah/go-simple-grpc/model"
+)
+
+type sqliteDialect struct{}
+
+// NewSQLiteRepository returns product repository that uses the given SQLite database
+func NewSQLiteRepository(db *sql.DB) *SQLRepository {
+	return &SQLRepository{db: db, dialect: sqliteDialect{}}
+}
+
+// rebind keeps the ? placeholders since SQLite supports them natively
+func (sqliteDialect) rebind(query string) string {
+	return query
+}
+
+// translate converts the SQLite errors into repository errors
+func (sqliteDialect) translate(err error) error {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return err
+	}
+
+	switch sqliteErr.ExtendedCode {
+	case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+		return &Error{Kind: Duplicate, Column: constraintColumn(sqliteErr), Err: err}
+	case sqlite3.ErrConstraintNotNull, sqlite3.ErrConstraintCheck:
+		return &Error{Kind: InvalidData, Column: constraintColumn(sqliteErr), Err: err}
+	}
+
+	switch sqliteErr.Code {
+	case sqlite3.ErrBusy, sqlite3.ErrLocked:
+		return &Error{Kind: Conflict, Err: err}
+	case sqlite3.ErrCantOpen, sqlite3.ErrIoErr:
+		return &Error{Kind: Unavailable, Err: err}
+	}
+	return err
+}
+
+// constraintColumn returns the column of a constraint error like
+// "NOT NULL constraint failed: products.category"
+func constraintColumn(err sqlite3.Error) string {
+	message := err.Error()
+	i := strings.LastIndex(message, ": ")
+	if i < 0 {
+		return ""
+	}
+	column := message[i+2:]
+	if j := strings.LastIndex(column, "."); j >= 0 {
+		column = column[j+1:]
+	}
+	return column
+}
+
+// forUpdate needs no clause since SQLite runs a single writing transaction at a time
+func (sqliteDialect) forUpdate() string {
+	return ""
+}
+
+// search finds the products containing every keyword with LIKE and ranks them in Go,
+// SQLite has no full-text search without the FTS5 extension
+func (sqliteDialect) search(ctx context.Context, q querier, opts SearchOptions) (SearchResult, error) {
+	conditions := []string{"deleted_at IS NULL"}
+	args := []interface{}{}
+	for _, term := range searchTerms(opts.Query) {
+		pattern := "%" + escapeLike(term) + "%"
+		conditions = append(conditions, `(lower(name) LIKE ? ESCAPE '\' OR lower(description) LIKE ? ESCAPE '\' OR lower(category) LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern, pattern)
+	}
+
+	rows, err := q.QueryContext(ctx, "SELECT "+productColumns+" FROM products WHERE "+strings.Join(conditions, " AND "), args...)
+	if err != nil {
+		return SearchResult{}, err
+	}
+
+	defer rows.Close()
+	products := []model.Product{}
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			return SearchResult{}, err
+		}
+		products = append(products, product)
+	}
+	if err := rows.Err(); err != nil {
+		return SearchResult{}, err
+	}
+	return substringSearch(products, opts), nil
+}
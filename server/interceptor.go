@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/nadirbasalamah/go-simple-grpc/auth"
+	"github.com/nadirbasalamah/go-simple-grpc/repository"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// productServicePrefix is the prefix of the full method names of the product service
+const productServicePrefix = "/product.ProductService/"
+
+// publicMethods are called without credentials
+var publicMethods = map[string]bool{
+	productServicePrefix + "Login": true,
+}
+
+// methodRoles maps the methods of the product service to the role they require, the methods
+// that aren't listed require the admin role
+var methodRoles = map[string]auth.Role{
+	productServicePrefix + "GetProduct":           auth.Viewer,
+	productServicePrefix + "GetProducts":          auth.Viewer,
+	productServicePrefix + "ListProducts":         auth.Viewer,
+	productServicePrefix + "SearchProducts":       auth.Viewer,
+	productServicePrefix + "WatchProducts":        auth.Viewer,
+	productServicePrefix + "CreateProduct":        auth.Editor,
+	productServicePrefix + "EditProduct":          auth.Editor,
+	productServicePrefix + "UpsertProduct":        auth.Editor,
+	productServicePrefix + "UndeleteProduct":      auth.Editor,
+	productServicePrefix + "RevertProduct":        auth.Editor,
+	productServicePrefix + "ListProductHistory":   auth.Editor,
+	productServicePrefix + "DeleteProduct":        auth.Admin,
+	productServicePrefix + "PurgeDeletedProducts": auth.Admin,
+	productServicePrefix + "CreateBatchProduct":   auth.Admin,
+	productServicePrefix + "UpsertProducts":       auth.Admin,
+}
+
+// requiredRole returns the role required by the method, the unknown methods and the methods
+// of other services such as reflection require the admin role
+func requiredRole(fullMethod string) auth.Role {
+	if role, ok := methodRoles[fullMethod]; ok {
+		return role
+	}
+	return auth.Admin
+}
+
+// interceptor authenticates and authorizes the requests and attributes their changes to the
+// caller
+type interceptor struct {
+	authenticator *auth.Authenticator
+}
+
+// prepare returns a copy of ctx carrying the authenticated caller of the request, the error
+// is an Unauthenticated status when the credentials are missing or wrong and PermissionDenied
+// when the role of the caller doesn't allow the method
+func (i *interceptor) prepare(ctx context.Context, fullMethod string) (context.Context, error) {
+	if publicMethods[fullMethod] {
+		return ctx, nil
+	}
+
+	principal, err := i.authenticator.Authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if required := requiredRole(fullMethod); !principal.Role.Allows(required) {
+		return nil, status.Errorf(codes.PermissionDenied, fmt.Sprintf("Role %s cannot call %s, it requires the %s role", principal.Role, path.Base(fullMethod), required))
+	}
+
+	actor := repository.Actor{Identity: principal.Name}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		actor.Peer = p.Addr.String()
+	}
+	return repository.WithActor(auth.NewContext(ctx, principal), actor), nil
+}
+
+// unary prepares the context of the unary requests
+func (i *interceptor) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := i.prepare(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// stream prepares the context of the streaming requests
+func (i *interceptor) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := i.prepare(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+}
+
+// serverStream replaces the context of a server stream
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the replaced context of the stream
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
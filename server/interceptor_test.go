@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nadirbasalamah/go-simple-grpc/auth"
+	"github.com/nadirbasalamah/go-simple-grpc/product/productpb"
+	"github.com/nadirbasalamah/go-simple-grpc/repository"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// testTokens are the static tokens of a caller of every role
+var testTokens = map[auth.Role]string{
+	auth.Viewer: "viewer-token",
+	auth.Editor: "editor-token",
+	auth.Admin:  "admin-token",
+}
+
+func newTestInterceptor(t *testing.T) *interceptor {
+	t.Helper()
+	tokens, err := auth.ParseTokens("vera:viewer-token:viewer, eddie:editor-token:editor, ada:admin-token:admin")
+	if err != nil {
+		t.Fatalf("ParseTokens() error = %v", err)
+	}
+	return &interceptor{authenticator: auth.NewAuthenticator(nil, tokens, nil)}
+}
+
+// withToken returns the server context of a request sent with the bearer token
+func withToken(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+}
+
+func TestInterceptorRoles(t *testing.T) {
+	i := newTestInterceptor(t)
+	tests := []struct {
+		method string
+		// required is the lowest role allowed to call the method, empty when it is public
+		required auth.Role
+	}{
+		{"Login", ""},
+		{"GetProduct", auth.Viewer},
+		{"GetProducts", auth.Viewer},
+		{"ListProducts", auth.Viewer},
+		{"SearchProducts", auth.Viewer},
+		{"WatchProducts", auth.Viewer},
+		{"CreateProduct", auth.Editor},
+		{"EditProduct", auth.Editor},
+		{"UpsertProduct", auth.Editor},
+		{"UndeleteProduct", auth.Editor},
+		{"RevertProduct", auth.Editor},
+		{"ListProductHistory", auth.Editor},
+		{"DeleteProduct", auth.Admin},
+		{"PurgeDeletedProducts", auth.Admin},
+		{"CreateBatchProduct", auth.Admin},
+		{"UpsertProducts", auth.Admin},
+	}
+
+	// every method of the service is covered
+	tested := map[string]bool{}
+	for _, tt := range tests {
+		tested[tt.method] = true
+	}
+	methods := productpb.File_product_productpb_product_proto.Services().ByName("ProductService").Methods()
+	for n := 0; n < methods.Len(); n++ {
+		if name := string(methods.Get(n).Name()); !tested[name] {
+			t.Errorf("method %s has no role test", name)
+		}
+	}
+
+	for _, tt := range tests {
+		for role, token := range testTokens {
+			t.Run(tt.method+"/"+string(role), func(t *testing.T) {
+				ctx, err := i.prepare(withToken(token), productServicePrefix+tt.method)
+				if !role.Allows(tt.required) {
+					if code := status.Code(err); code != codes.PermissionDenied {
+						t.Errorf("prepare() code = %v, want %v", code, codes.PermissionDenied)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("prepare() error = %v", err)
+				}
+				if actor := repository.ActorFromContext(ctx); tt.required != "" && actor.Identity == "" {
+					t.Errorf("prepare() actor = %+v, want the caller", actor)
+				}
+			})
+		}
+	}
+}
+
+func TestInterceptorUnknownMethods(t *testing.T) {
+	i := newTestInterceptor(t)
+	for _, method := range []string{
+		productServicePrefix + "DropProducts",
+		"/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo",
+	} {
+		for role, token := range testTokens {
+			_, err := i.prepare(withToken(token), method)
+			want := codes.PermissionDenied
+			if role == auth.Admin {
+				want = codes.OK
+			}
+			if code := status.Code(err); code != want {
+				t.Errorf("prepare(%s) by %s code = %v, want %v", method, role, code, want)
+			}
+		}
+	}
+}
+
+func TestInterceptorUnauthenticated(t *testing.T) {
+	i := newTestInterceptor(t)
+	if _, err := i.prepare(context.Background(), productServicePrefix+"GetProduct"); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("prepare() without credentials code = %v, want %v", status.Code(err), codes.Unauthenticated)
+	}
+	if _, err := i.prepare(withToken("wrong-token"), productServicePrefix+"GetProduct"); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("prepare() with wrong token code = %v, want %v", status.Code(err), codes.Unauthenticated)
+	}
+}
@@ -4,26 +4,45 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nadirbasalamah/go-simple-grpc/auth"
+	"github.com/nadirbasalamah/go-simple-grpc/config"
 	"github.com/nadirbasalamah/go-simple-grpc/database"
+	"github.com/nadirbasalamah/go-simple-grpc/events"
 	"github.com/nadirbasalamah/go-simple-grpc/model"
+	"github.com/nadirbasalamah/go-simple-grpc/outbox"
 	"github.com/nadirbasalamah/go-simple-grpc/product/productpb"
+	"github.com/nadirbasalamah/go-simple-grpc/repository"
 	"github.com/nadirbasalamah/go-simple-grpc/service"
+	"github.com/nadirbasalamah/go-simple-grpc/validation"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type server struct {
+	service       *service.ProductService
+	authenticator *auth.Authenticator
+	// upsertBatchSize is the number of UpsertProducts requests written at once
+	upsertBatchSize int
+	// upsertFlushInterval is the longest time an UpsertProducts request waits for its batch
+	upsertFlushInterval time.Duration
 }
 
-func (*server) CreateProduct(ctx context.Context, req *productpb.CreateProductRequest) (*productpb.CreateProductResponse, error) {
+func (srv *server) CreateProduct(ctx context.Context, req *productpb.CreateProductRequest) (*productpb.CreateProductResponse, error) {
 	productReq := req.GetProduct()
 
 	product := model.Product{
@@ -33,7 +52,7 @@ func (*server) CreateProduct(ctx context.Context, req *productpb.CreateProductRe
 		Amount:      int(productReq.GetAmount()),
 	}
 
-	createdProduct, err := service.CreateProduct(product)
+	createdProduct, err := srv.service.CreateProduct(ctx, product, idempotencyKey(ctx, req.GetIdempotencyKey()))
 	if err != nil {
 		return nil, err
 	}
@@ -42,10 +61,22 @@ func (*server) CreateProduct(ctx context.Context, req *productpb.CreateProductRe
 		Product: dataToProductPb(&createdProduct),
 	}, nil
 }
-func (*server) GetProduct(ctx context.Context, req *productpb.GetProductRequest) (*productpb.GetProductResponse, error) {
+func (srv *server) GetProduct(ctx context.Context, req *productpb.GetProductRequest) (*productpb.GetProductResponse, error) {
 	id := req.GetProductId()
 
-	product, err := service.GetProduct(id)
+	var product model.Product
+	var err error
+	switch asOf := req.GetAsOf().(type) {
+	case *productpb.GetProductRequest_AsOfTime:
+		if err := asOf.AsOfTime.CheckValid(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("Invalid as of time: %v", err))
+		}
+		product, err = srv.service.GetProductAsOf(ctx, id, repository.AsOf{Time: asOf.AsOfTime.AsTime()}, req.GetShowDeleted())
+	case *productpb.GetProductRequest_AsOfVersion:
+		product, err = srv.service.GetProductAsOf(ctx, id, repository.AsOf{Version: int(asOf.AsOfVersion)}, req.GetShowDeleted())
+	default:
+		product, err = srv.service.GetProduct(ctx, id, req.GetShowDeleted())
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -54,7 +85,7 @@ func (*server) GetProduct(ctx context.Context, req *productpb.GetProductRequest)
 		Product: dataToProductPb(&product),
 	}, nil
 }
-func (*server) EditProduct(ctx context.Context, req *productpb.EditProductRequest) (*productpb.EditProductResponse, error) {
+func (srv *server) EditProduct(ctx context.Context, req *productpb.EditProductRequest) (*productpb.EditProductResponse, error) {
 	productReq := req.GetProduct()
 	id := productReq.GetId()
 
@@ -63,9 +94,10 @@ func (*server) EditProduct(ctx context.Context, req *productpb.EditProductReques
 		Description: productReq.GetDescription(),
 		Category:    productReq.GetCategory(),
 		Amount:      int(productReq.GetAmount()),
+		Version:     int(productReq.GetVersion()),
 	}
 
-	editedProduct, err := service.EditProduct(product, id)
+	editedProduct, err := srv.service.EditProduct(ctx, product, id, req.GetUpdateMask().GetPaths())
 	if err != nil {
 		return nil, err
 	}
@@ -74,10 +106,41 @@ func (*server) EditProduct(ctx context.Context, req *productpb.EditProductReques
 		Product: dataToProductPb(&editedProduct),
 	}, nil
 }
-func (*server) DeleteProduct(ctx context.Context, req *productpb.DeleteProductRequest) (*productpb.DeleteProductResponse, error) {
+
+func (srv *server) UpsertProduct(ctx context.Context, req *productpb.UpsertProductRequest) (*productpb.UpsertProductResponse, error) {
+	productReq := req.GetProduct()
+
+	product := model.Product{
+		Name:        productReq.GetName(),
+		Description: productReq.GetDescription(),
+		Category:    productReq.GetCategory(),
+		Amount:      int(productReq.GetAmount()),
+	}
+
+	upsertedProduct, created, err := srv.service.UpsertProduct(ctx, product)
+	if err != nil {
+		return nil, err
+	}
+
+	return &productpb.UpsertProductResponse{
+		Product: dataToProductPb(&upsertedProduct),
+		Created: created,
+	}, nil
+}
+func (srv *server) RevertProduct(ctx context.Context, req *productpb.RevertProductRequest) (*productpb.RevertProductResponse, error) {
+	product, err := srv.service.RevertProduct(ctx, req.GetProductId(), req.GetVersion(), req.GetExpectedVersion())
+	if err != nil {
+		return nil, err
+	}
+
+	return &productpb.RevertProductResponse{
+		Product: dataToProductPb(&product),
+	}, nil
+}
+func (srv *server) DeleteProduct(ctx context.Context, req *productpb.DeleteProductRequest) (*productpb.DeleteProductResponse, error) {
 	id := req.GetProductId()
 
-	err := service.DeleteProduct(id)
+	err := srv.service.DeleteProduct(ctx, id, req.GetExpectedVersion())
 	if err != nil {
 		return nil, err
 	}
@@ -86,20 +149,143 @@ func (*server) DeleteProduct(ctx context.Context, req *productpb.DeleteProductRe
 		ProductId: id,
 	}, nil
 }
-func (*server) GetProducts(req *productpb.GetProductsRequest, stream productpb.ProductService_GetProductsServer) error {
-	err := service.GetProducts(stream)
+func (srv *server) UndeleteProduct(ctx context.Context, req *productpb.UndeleteProductRequest) (*productpb.UndeleteProductResponse, error) {
+	product, err := srv.service.UndeleteProduct(ctx, req.GetProductId())
+	if err != nil {
+		return nil, err
+	}
+
+	return &productpb.UndeleteProductResponse{
+		Product: dataToProductPb(&product),
+	}, nil
+}
+func (srv *server) PurgeDeletedProducts(ctx context.Context, req *productpb.PurgeDeletedProductsRequest) (*productpb.PurgeDeletedProductsResponse, error) {
+	if req.GetOlderThan() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Purge age is required")
+	}
+	if err := req.GetOlderThan().CheckValid(); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid purge age: %v", err)
+	}
+
+	purged, err := srv.service.PurgeDeletedProducts(ctx, req.GetOlderThan().AsDuration())
+	if err != nil {
+		return nil, err
+	}
+
+	return &productpb.PurgeDeletedProductsResponse{
+		PurgedCount: int32(purged),
+	}, nil
+}
+func (srv *server) GetProducts(req *productpb.GetProductsRequest, stream productpb.ProductService_GetProductsServer) error {
+	err := srv.service.GetProducts(pbToProductQuery(req), stream)
 	if err != nil {
 		return err
 	}
 	return nil
 }
-func (*server) CreateBatchProduct(stream productpb.ProductService_CreateBatchProductServer) error {
+func (srv *server) ListProducts(ctx context.Context, req *productpb.ListProductsRequest) (*productpb.ListProductsResponse, error) {
+	result, nextPageToken, err := srv.service.ListProducts(ctx, pbToProductQuery(req))
+	if err != nil {
+		return nil, err
+	}
+
+	res := &productpb.ListProductsResponse{
+		NextPageToken: nextPageToken,
+		TotalCount:    int32(result.TotalCount),
+	}
+	for i := range result.Products {
+		res.Products = append(res.Products, dataToProductPb(&result.Products[i]))
+	}
+	return res, nil
+}
+
+func (srv *server) SearchProducts(ctx context.Context, req *productpb.SearchProductsRequest) (*productpb.SearchProductsResponse, error) {
+	result, nextPageToken, err := srv.service.SearchProducts(ctx, model.SearchQuery{
+		Query:     req.GetQuery(),
+		Category:  req.GetCategory(),
+		PageSize:  int(req.GetPageSize()),
+		PageToken: req.GetPageToken(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &productpb.SearchProductsResponse{
+		NextPageToken: nextPageToken,
+		TotalCount:    int32(result.TotalCount),
+	}
+	for i, hit := range result.Hits {
+		res.Hits = append(res.Hits, &productpb.SearchHit{
+			Product:   dataToProductPb(&result.Hits[i].Product),
+			Rank:      float32(hit.Rank),
+			Highlight: hit.Highlight,
+		})
+	}
+	for _, facet := range result.Facets {
+		res.Facets = append(res.Facets, &productpb.CategoryFacet{
+			Category: facet.Category,
+			Count:    int32(facet.Count),
+		})
+	}
+	return res, nil
+}
+func (srv *server) Login(ctx context.Context, req *productpb.LoginRequest) (*productpb.LoginResponse, error) {
+	token, expiresAt, principal, err := srv.authenticator.Login(req.GetUsername(), req.GetPassword())
+	if err != nil {
+		return nil, err
+	}
+
+	return &productpb.LoginResponse{
+		AccessToken: token,
+		ExpiresAt:   timestamppb.New(expiresAt),
+		Role:        string(principal.Role),
+	}, nil
+}
+
+func (srv *server) ListProductHistory(ctx context.Context, req *productpb.ListProductHistoryRequest) (*productpb.ListProductHistoryResponse, error) {
+	result, nextPageToken, err := srv.service.ListProductHistory(ctx, model.HistoryQuery{
+		ProductID: int(req.GetProductId()),
+		PageSize:  int(req.GetPageSize()),
+		PageToken: req.GetPageToken(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &productpb.ListProductHistoryResponse{NextPageToken: nextPageToken}
+	for i, entry := range result.Entries {
+		pbEntry := &productpb.ProductHistoryEntry{
+			Id:      entry.ID,
+			Action:  entry.Action,
+			Actor:   entry.Actor.Identity,
+			Peer:    entry.Actor.Peer,
+			Time:    timestamppb.New(entry.Time),
+			Product: dataToProductPb(&result.Entries[i].Product),
+		}
+		for _, change := range entry.Changes {
+			pbEntry.Changes = append(pbEntry.Changes, &productpb.FieldChange{
+				Field:  change.Field,
+				Before: change.Before,
+				After:  change.After,
+			})
+		}
+		res.Entries = append(res.Entries, pbEntry)
+	}
+	return res, nil
+}
+
+func (srv *server) WatchProducts(req *productpb.WatchProductsRequest, stream productpb.ProductService_WatchProductsServer) error {
+	return srv.service.WatchProducts(req.GetAfterRevision(), req.GetCategories(), stream)
+}
+
+func (srv *server) CreateBatchProduct(stream productpb.ProductService_CreateBatchProductServer) error {
+	products := []model.Product{}
+	atomic := true
+	key := ""
 	for {
 		req, err := stream.Recv()
 		if err == io.EOF {
-			return stream.SendAndClose(&productpb.CreateBatchProductResponse{
-				BatchResult: "All the data successfully inserted!",
-			})
+			break
 		}
 		if err != nil {
 			return status.Errorf(
@@ -107,23 +293,174 @@ func (*server) CreateBatchProduct(stream productpb.ProductService_CreateBatchPro
 				fmt.Sprintf("Internal error, insert batch failed: %v", err),
 			)
 		}
-		product := model.Product{
+		if len(products) == 0 {
+			atomic = req.GetMode() == productpb.BatchMode_BATCH_MODE_ATOMIC
+			key = req.GetIdempotencyKey()
+		}
+		products = append(products, model.Product{
 			Name:        req.GetProduct().GetName(),
 			Description: req.GetProduct().GetDescription(),
 			Category:    req.GetProduct().GetCategory(),
 			Amount:      int(req.GetProduct().GetAmount()),
+		})
+	}
+
+	results, err := srv.service.CreateBatchProduct(stream.Context(), products, atomic, idempotencyKey(stream.Context(), key))
+	if err != nil {
+		return err
+	}
+
+	res := &productpb.CreateBatchProductResponse{}
+	for _, result := range results {
+		if result.Code == codes.OK {
+			res.CreatedCount++
 		}
+		res.Results = append(res.Results, &productpb.BatchItemResult{
+			Index:     int32(result.Index),
+			ProductId: int32(result.Product.ID),
+			Code:      int32(result.Code),
+			Message:   result.Message,
+		})
+	}
 
-		_, err2 := service.CreateProduct(product)
-		if err2 != nil {
-			return status.Errorf(
-				codes.Internal,
-				fmt.Sprintf("Internal error, insert batch failed: %v", err),
-			)
+	return stream.SendAndClose(res)
+}
+
+func (srv *server) UpsertProducts(stream productpb.ProductService_UpsertProductsServer) error {
+	requests := make(chan *productpb.UpsertProductsRequest)
+	recvErr := make(chan error, 1)
+	go func() {
+		defer close(requests)
+		for {
+			req, err := stream.Recv()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case requests <- req:
+			case <-stream.Context().Done():
+				return
+			}
 		}
+	}()
+
+	pending := []*productpb.UpsertProductsRequest{}
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+
+		products := []model.Product{}
+		for _, req := range pending {
+			products = append(products, model.Product{
+				ID:          int(req.GetProduct().GetId()),
+				Name:        req.GetProduct().GetName(),
+				Description: req.GetProduct().GetDescription(),
+				Category:    req.GetProduct().GetCategory(),
+				Amount:      int(req.GetProduct().GetAmount()),
+				Version:     int(req.GetProduct().GetVersion()),
+			})
+		}
+
+		results, err := srv.service.UpsertProducts(stream.Context(), products)
+		if err != nil {
+			return err
+		}
+
+		for i, result := range results {
+			res := &productpb.UpsertProductsResponse{
+				CorrelationId: pending[i].GetCorrelationId(),
+				Created:       result.Created,
+				Code:          int32(result.Code),
+				Message:       result.Message,
+			}
+			if result.Code == codes.OK {
+				res.Product = dataToProductPb(&result.Product)
+			}
+			if err := stream.Send(res); err != nil {
+				return err
+			}
+		}
+		pending = pending[:0]
+		return nil
+	}
+
+	ticker := time.NewTicker(srv.upsertFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case req, ok := <-requests:
+			if !ok {
+				if err := flush(); err != nil {
+					return err
+				}
+				select {
+				case err := <-recvErr:
+					return status.Errorf(
+						codes.Internal,
+						fmt.Sprintf("Internal error, upsert failed: %v", err),
+					)
+				default:
+					return nil
+				}
+			}
+			pending = append(pending, req)
+			if len(pending) >= srv.upsertBatchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		case <-ticker.C:
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// productQueryRequest is implemented by the requests that list products
+type productQueryRequest interface {
+	GetPageSize() int32
+	GetPageToken() string
+	GetFilter() *productpb.ProductFilter
+	GetSortBy() productpb.SortField
+	GetDescending() bool
+}
+
+func pbToProductQuery(req productQueryRequest) model.ProductQuery {
+	filter := model.ProductFilter{
+		Category:    req.GetFilter().GetCategory(),
+		NamePrefix:  req.GetFilter().GetNamePrefix(),
+		ShowDeleted: req.GetFilter().GetShowDeleted(),
+	}
+	if minAmount := req.GetFilter().GetMinAmount(); minAmount != nil {
+		value := int(minAmount.GetValue())
+		filter.MinAmount = &value
+	}
+	if maxAmount := req.GetFilter().GetMaxAmount(); maxAmount != nil {
+		value := int(maxAmount.GetValue())
+		filter.MaxAmount = &value
+	}
+
+	return model.ProductQuery{
+		Filter:     filter,
+		SortBy:     pbToSortField[req.GetSortBy()],
+		Descending: req.GetDescending(),
+		PageSize:   int(req.GetPageSize()),
+		PageToken:  req.GetPageToken(),
 	}
 }
 
+var pbToSortField = map[productpb.SortField]model.SortField{
+	productpb.SortField_SORT_FIELD_NAME:   model.SortByName,
+	productpb.SortField_SORT_FIELD_ID:     model.SortByID,
+	productpb.SortField_SORT_FIELD_AMOUNT: model.SortByAmount,
+}
+
 func dataToProductPb(data *model.Product) *productpb.Product {
 	return &productpb.Product{
 		Id:          int32(data.ID),
@@ -131,7 +468,197 @@ func dataToProductPb(data *model.Product) *productpb.Product {
 		Description: data.Description,
 		Category:    data.Category,
 		Amount:      int32(data.Amount),
+		Version:     int32(data.Version),
+		DeletedAt:   deletedAtToPb(data.DeletedAt),
+	}
+}
+
+func deletedAtToPb(deletedAt *time.Time) *timestamppb.Timestamp {
+	if deletedAt == nil {
+		return nil
+	}
+	return timestamppb.New(*deletedAt)
+}
+
+// newRepository returns the storage based on the STORAGE config, PostgreSQL is used when
+// it is not set
+func newRepository() (repository.Storage, error) {
+	switch storage := config.Config("STORAGE"); storage {
+	case "", "postgres":
+		if err := database.Connect(); err != nil {
+			return nil, err
+		}
+		return repository.NewPostgresRepository(database.DB), nil
+	case "sqlite":
+		if err := database.ConnectSQLite(); err != nil {
+			return nil, err
+		}
+		return repository.NewSQLiteRepository(database.DB), nil
+	case "memory":
+		fmt.Println("Using in-memory storage")
+		return repository.NewMemoryRepository(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage: %s", storage)
+	}
+}
+
+// newRelay returns the relay of the outbox messages to the sink of the OUTBOX_SINK config,
+// nil when it is not set
+func newRelay(store repository.OutboxStore) (*outbox.Relay, error) {
+	var sink outbox.Sink
+	switch name := config.Config("OUTBOX_SINK"); name {
+	case "":
+		return nil, nil
+	case "stdout":
+		sink = outbox.NewStdoutSink()
+	case "file":
+		fileSink, err := outbox.NewFileSink(config.Config("OUTBOX_FILE"))
+		if err != nil {
+			return nil, err
+		}
+		sink = fileSink
+	case "webhook":
+		sink = outbox.NewWebhookSink(config.Config("OUTBOX_WEBHOOK_URL"), configDuration("OUTBOX_WEBHOOK_TIMEOUT", 10*time.Second))
+	default:
+		return nil, fmt.Errorf("unknown outbox sink: %s", name)
+	}
+
+	relay := outbox.NewRelay(store, sink)
+	relay.PollInterval = configDuration("OUTBOX_POLL_INTERVAL", time.Second)
+	relay.Lease = configDuration("OUTBOX_LEASE", time.Minute)
+	relay.MaxBackoff = configDuration("OUTBOX_MAX_BACKOFF", 5*time.Minute)
+	relay.Retention = configDuration("OUTBOX_RETENTION", 7*24*time.Hour)
+	return relay, nil
+}
+
+// newFeed returns the feed of product changes, on PostgreSQL it listens to the changes
+// notified by the database so the writes of every server are seen
+func newFeed() (events.Feed, error) {
+	// product changes are kept for watchers resuming after a reconnect
+	broker := events.NewBroker(configInt("WATCH_HISTORY_SIZE", 1000), configInt("WATCH_BUFFER_SIZE", 100))
+	switch config.Config("STORAGE") {
+	case "", "postgres":
+		return events.NewPostgresFeed(database.DB, database.DSN(), broker)
+	default:
+		return broker, nil
+	}
+}
+
+// newAuthenticator returns authenticator of the USERNAME and PASSWORD admin, of the AUTH_USERS
+// users, a comma separated list of name:password:role, of the AUTH_TOKENS static bearer tokens,
+// a comma separated list of name:token:role, and of the tokens issued by Login
+func newAuthenticator() *auth.Authenticator {
+	users, err := auth.ParseUsers(config.Config("AUTH_USERS"))
+	if err != nil {
+		log.Fatalf("Invalid AUTH_USERS: %v\n", err)
 	}
+	users = append(users, auth.User{Name: config.Config("USERNAME"), Password: config.Config("PASSWORD"), Role: auth.Admin})
+
+	tokens, err := auth.ParseTokens(config.Config("AUTH_TOKENS"))
+	if err != nil {
+		log.Fatalf("Invalid AUTH_TOKENS: %v\n", err)
+	}
+
+	issuer, err := newIssuer()
+	if err != nil {
+		log.Fatalf("Invalid token signing key: %v\n", err)
+	}
+
+	authenticator := auth.NewAuthenticator(users, tokens, issuer)
+	if !authenticator.Enabled() {
+		log.Fatalf("No credentials configured, set USERNAME and PASSWORD, AUTH_USERS or AUTH_TOKENS\n")
+	}
+	return authenticator
+}
+
+// newIssuer returns the issuer of the Login tokens, signed with the JWT_SECRET HMAC secret or
+// with the RSA key of the JWT_PRIVATE_KEY_FILE file. A server with the JWT_PUBLIC_KEY_FILE key
+// only verifies the tokens, Login is disabled when no key is set
+func newIssuer() (*auth.Issuer, error) {
+	name := config.Config("JWT_ISSUER")
+	if name == "" {
+		name = "go-simple-grpc"
+	}
+	ttl := configDuration("JWT_TTL", time.Hour)
+
+	secret := config.Config("JWT_SECRET")
+	privateKeyFile, publicKeyFile := config.Config("JWT_PRIVATE_KEY_FILE"), config.Config("JWT_PUBLIC_KEY_FILE")
+	switch {
+	case secret != "" && (privateKeyFile != "" || publicKeyFile != ""):
+		return nil, fmt.Errorf("set either JWT_SECRET or the RSA key files")
+	case secret != "":
+		return auth.NewHMACIssuer([]byte(secret), name, ttl)
+	case privateKeyFile != "" || publicKeyFile != "":
+		var privateKey, publicKey []byte
+		var err error
+		if privateKeyFile != "" {
+			if privateKey, err = ioutil.ReadFile(privateKeyFile); err != nil {
+				return nil, err
+			}
+		}
+		if publicKeyFile != "" {
+			if publicKey, err = ioutil.ReadFile(publicKeyFile); err != nil {
+				return nil, err
+			}
+		}
+		return auth.NewRSAIssuer(privateKey, publicKey, name, ttl)
+	default:
+		return nil, nil
+	}
+}
+
+// newValidator returns product validator, PRODUCT_CATEGORIES is the comma separated list
+// of allowed categories and any category is allowed when it is not set
+func newValidator() *validation.Validator {
+	categories := []string{}
+	for _, category := range strings.Split(config.Config("PRODUCT_CATEGORIES"), ",") {
+		if category = strings.TrimSpace(category); category != "" {
+			categories = append(categories, category)
+		}
+	}
+	return validation.New(validation.ProductRules(categories))
+}
+
+// configInt returns the positive integer config of the key, or def when it is not set
+func configInt(key string, def int) int {
+	value := config.Config(key)
+	if value == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Fatalf("Invalid %s: %s\n", key, value)
+	}
+	return n
+}
+
+// idempotencyKey returns the key of the request field, or of the idempotency-key metadata
+// when the field is empty
+func idempotencyKey(ctx context.Context, key string) string {
+	if key != "" {
+		return key
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("idempotency-key"); len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// configDuration returns the positive duration config of the key, or def when it is not set
+func configDuration(key string, def time.Duration) time.Duration {
+	value := config.Config(key)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Fatalf("Invalid %s: %s\n", key, value)
+	}
+	return d
 }
 
 func main() {
@@ -140,19 +667,50 @@ func main() {
 
 	fmt.Println("Product service started")
 
-	// connect to DB
-	if err := database.Connect(); err != nil {
+	// connect to the configured storage
+	repo, err := newRepository()
+	if err != nil {
 		log.Fatal(err)
 	}
 
+	// deliver the product changes written in the outbox
+	relay, err := newRelay(repo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	relayDone := make(chan struct{})
+	go func() {
+		defer close(relayDone)
+		if relay != nil {
+			relay.Run(relayCtx)
+		}
+	}()
+
 	lis, err := net.Listen("tcp", "0.0.0.0:50051")
 	if err != nil {
 		log.Fatalf("Failed to listen: %v\n", err)
 	}
 
-	s := grpc.NewServer()
+	feed, err := newFeed()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// every request except Login must be authenticated
+	authenticator := newAuthenticator()
+	interceptor := &interceptor{authenticator: authenticator}
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(interceptor.unary),
+		grpc.StreamInterceptor(interceptor.stream),
+	)
 	// register product service server
-	productpb.RegisterProductServiceServer(s, &server{})
+	productpb.RegisterProductServiceServer(s, &server{
+		authenticator:       authenticator,
+		service:             service.NewProductService(repo, newValidator(), repo, configDuration("IDEMPOTENCY_TTL", 24*time.Hour), feed),
+		upsertBatchSize:     configInt("UPSERT_BATCH_SIZE", 100),
+		upsertFlushInterval: configDuration("UPSERT_FLUSH_INTERVAL", 100*time.Millisecond),
+	})
 	// enable gRPC reflection
 	reflection.Register(s)
 
@@ -173,5 +731,9 @@ func main() {
 	s.Stop()
 	fmt.Println("Stopping listener...")
 	lis.Close()
+	feed.Close()
+	fmt.Println("Stopping outbox relay...")
+	stopRelay()
+	<-relayDone
 	fmt.Println("End of Program")
 }
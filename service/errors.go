@@ -0,0 +1,76 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/nadirbasalamah/go-simple-grpc/repository"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// retryDelay is the delay suggested to clients for the errors that can be retried
+const retryDelay = time.Second
+
+// repositoryError returns the gRPC status of a repository error, action describes the failed
+// operation for the Internal errors. The underlying database error is only logged since it
+// may contain SQL or table details
+func repositoryError(err error, action string) error {
+	var dbErr *repository.Error
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		return status.Errorf(codes.NotFound, fmt.Sprintf("Data not found: %v", repository.ErrNotFound))
+	case errors.Is(err, repository.ErrVersionNotFound):
+		return status.Errorf(codes.NotFound, fmt.Sprintf("Data not found: %v", repository.ErrVersionNotFound))
+	case errors.Is(err, repository.ErrAlreadyExists):
+		return withDetails(
+			status.New(codes.AlreadyExists, fmt.Sprintf("Product cannot be stored: %v", repository.ErrAlreadyExists)),
+			&errdetails.ErrorInfo{Reason: "PRODUCT_NAME_EXISTS", Domain: "product", Metadata: map[string]string{"field": "name"}},
+		)
+	case errors.Is(err, repository.ErrVersionMismatch):
+		return status.Errorf(codes.Aborted, fmt.Sprintf("Product was changed by another request: %v", repository.ErrVersionMismatch))
+	case errors.Is(err, repository.ErrNotDeleted):
+		return status.Errorf(codes.FailedPrecondition, fmt.Sprintf("Product cannot be restored: %v", repository.ErrNotDeleted))
+	case errors.Is(err, repository.ErrBatchAborted):
+		return status.Error(codes.Aborted, repository.ErrBatchAborted.Error())
+	case errors.As(err, &dbErr):
+		log.Printf("%s failed: %v\n", action, err)
+		switch dbErr.Kind {
+		case repository.InvalidData:
+			violation := &errdetails.BadRequest_FieldViolation{Field: "product", Description: "rejected by the database"}
+			if dbErr.Column != "" {
+				violation.Field = "product." + dbErr.Column
+			}
+			return withDetails(
+				status.New(codes.InvalidArgument, "Invalid product: rejected by the database"),
+				&errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{violation}},
+			)
+		case repository.Conflict:
+			return withDetails(
+				status.New(codes.Aborted, "Product was changed by a concurrent request, retry the request"),
+				&errdetails.RetryInfo{RetryDelay: durationpb.New(retryDelay)},
+			)
+		case repository.Unavailable:
+			return withDetails(
+				status.New(codes.Unavailable, "Database is unavailable, retry the request later"),
+				&errdetails.RetryInfo{RetryDelay: durationpb.New(retryDelay)},
+			)
+		}
+	default:
+		log.Printf("%s failed: %v\n", action, err)
+	}
+	return status.Errorf(codes.Internal, fmt.Sprintf("Internal error, %s failed", action))
+}
+
+// withDetails returns the error of the status with the given details attached
+func withDetails(st *status.Status, details ...proto.Message) error {
+	if detailed, err := st.WithDetails(details...); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
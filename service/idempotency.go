@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nadirbasalamah/go-simple-grpc/repository"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const maxIdempotencyKeyLength = 255
+
+// idempotencyLease is how long a key is reserved by a write in progress, a retry after it
+// ended takes the key over so a key isn't stuck when the server stopped during the write
+const idempotencyLease = time.Minute
+
+// idempotent runs write once per idempotency key of the caller and method and stores the
+// response it filled for the TTL of the service, a retry with the same key gets the stored response
+// decoded into response instead of running write again. write runs directly when key is empty
+func (s *ProductService) idempotent(ctx context.Context, method string, key string, request interface{}, response interface{}, write func() error) error {
+	if key == "" || s.idempotency == nil {
+		return write()
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprintf("Idempotency key must not be longer than %d characters", maxIdempotencyKeyLength),
+		)
+	}
+
+	encodedRequest, err := json.Marshal(request)
+	if err != nil {
+		return status.Errorf(codes.Internal, fmt.Sprintf("Internal error, encode request failed: %v", err))
+	}
+	hash := sha256.Sum256(encodedRequest)
+
+	// keys are scoped by caller so callers can't read each other's responses, and by method
+	// so the same key can be used for different kinds of writes
+	record, reserved, err := s.idempotency.Reserve(ctx, repository.IdempotencyRecord{
+		Key:         repository.ActorFromContext(ctx).Identity + "/" + method + "/" + key,
+		RequestHash: hex.EncodeToString(hash[:]),
+		ExpiresAt:   time.Now().Add(idempotencyLease),
+	})
+	if err != nil {
+		return repositoryError(err, "reserve idempotency key")
+	}
+	if !reserved {
+		switch {
+		case record.RequestHash != hex.EncodeToString(hash[:]):
+			return status.Errorf(
+				codes.InvalidArgument,
+				fmt.Sprintf("Idempotency key %s was already used with a different request", key),
+			)
+		case record.Response == nil:
+			return status.Errorf(
+				codes.Aborted,
+				fmt.Sprintf("Request with idempotency key %s is still in progress", key),
+			)
+		}
+		if err := json.Unmarshal(record.Response, response); err != nil {
+			return status.Errorf(codes.Internal, fmt.Sprintf("Internal error, decode stored response failed: %v", err))
+		}
+		return nil
+	}
+
+	// the reservation is settled even when the client gave up on the request, otherwise
+	// its retries would be rejected until the key expires
+	settleCtx := context.Background()
+	if err := write(); err != nil {
+		if err := s.idempotency.Release(settleCtx, record.Key); err != nil {
+			log.Printf("Release idempotency key %s failed: %v\n", record.Key, err)
+		}
+		return err
+	}
+
+	encodedResponse, err := json.Marshal(response)
+	if err == nil {
+		err = s.idempotency.Complete(settleCtx, record.Key, encodedResponse, time.Now().Add(s.idempotencyTTL))
+	}
+	if err != nil {
+		// the write succeeded, retries are rejected as in progress until the lease ends
+		log.Printf("Complete idempotency key %s failed: %v\n", record.Key, err)
+	}
+	return nil
+}
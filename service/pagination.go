@@ -0,0 +1,133 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	"github.com/nadirbasalamah/go-simple-grpc/model"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 100
+)
+
+var errInvalidPageToken = errors.New("invalid page token")
+
+// pageToken represents the position of the last product of a page, together with the
+// query it belongs to so it can't be reused with different filters or sorting
+type pageToken struct {
+	SortBy     model.SortField `json:"s"`
+	Descending bool            `json:"d"`
+	Filter     string          `json:"f"`
+	ID         int             `json:"i"`
+	Name       string          `json:"n,omitempty"`
+	Amount     int             `json:"a,omitempty"`
+}
+
+// encodePageToken returns the token of the page that follows the given product
+func encodePageToken(query model.ProductQuery, last model.Product) string {
+	token, _ := json.Marshal(pageToken{
+		SortBy:     query.SortBy,
+		Descending: query.Descending,
+		Filter:     filterFingerprint(query.Filter),
+		ID:         last.ID,
+		Name:       last.Name,
+		Amount:     last.Amount,
+	})
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+// decodePageToken returns the last product of the previous page stored in the token of the query
+func decodePageToken(query model.ProductQuery) (model.Product, error) {
+	data, err := base64.RawURLEncoding.DecodeString(query.PageToken)
+	if err != nil {
+		return model.Product{}, errInvalidPageToken
+	}
+
+	token := pageToken{}
+	if err := json.Unmarshal(data, &token); err != nil {
+		return model.Product{}, errInvalidPageToken
+	}
+	if token.SortBy != query.SortBy || token.Descending != query.Descending || token.Filter != filterFingerprint(query.Filter) {
+		return model.Product{}, errors.New("page token does not match the filter and sorting of the request")
+	}
+
+	return model.Product{ID: token.ID, Name: token.Name, Amount: token.Amount}, nil
+}
+
+func filterFingerprint(filter model.ProductFilter) string {
+	data, _ := json.Marshal(filter)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// searchPageToken represents the number of hits already returned for a search
+type searchPageToken struct {
+	Query  string `json:"q"`
+	Offset int    `json:"o"`
+}
+
+// encodeSearchPageToken returns the token of the search page that starts at offset
+func encodeSearchPageToken(query model.SearchQuery, offset int) string {
+	token, _ := json.Marshal(searchPageToken{Query: searchFingerprint(query), Offset: offset})
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+// decodeSearchPageToken returns the offset stored in the page token of the search
+func decodeSearchPageToken(query model.SearchQuery) (int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(query.PageToken)
+	if err != nil {
+		return 0, errInvalidPageToken
+	}
+
+	token := searchPageToken{}
+	if err := json.Unmarshal(data, &token); err != nil || token.Offset < 0 {
+		return 0, errInvalidPageToken
+	}
+	if token.Query != searchFingerprint(query) {
+		return 0, errors.New("page token does not match the query and category of the request")
+	}
+	return token.Offset, nil
+}
+
+func searchFingerprint(query model.SearchQuery) string {
+	data, _ := json.Marshal([]string{query.Query, query.Category})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// historyPageToken represents the last audit entry of a history page
+type historyPageToken struct {
+	ProductID int   `json:"p"`
+	ID        int64 `json:"i"`
+}
+
+// encodeHistoryPageToken returns the token of the history page that follows the given entry
+func encodeHistoryPageToken(query model.HistoryQuery, lastID int64) string {
+	token, _ := json.Marshal(historyPageToken{ProductID: query.ProductID, ID: lastID})
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+// decodeHistoryPageToken returns the id of the last entry stored in the page token of the query
+func decodeHistoryPageToken(query model.HistoryQuery) (int64, error) {
+	data, err := base64.RawURLEncoding.DecodeString(query.PageToken)
+	if err != nil {
+		return 0, errInvalidPageToken
+	}
+
+	token := historyPageToken{}
+	if err := json.Unmarshal(data, &token); err != nil || token.ID <= 0 {
+		return 0, errInvalidPageToken
+	}
+	if token.ProductID != query.ProductID {
+		return 0, errors.New("page token does not match the product of the request")
+	}
+	return token.ID, nil
+}
@@ -1,129 +1,625 @@
 package service
 
 import (
-	"database/sql"
+	"context"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/nadirbasalamah/go-simple-grpc/database"
+	"github.com/nadirbasalamah/go-simple-grpc/events"
 	"github.com/nadirbasalamah/go-simple-grpc/model"
 	"github.com/nadirbasalamah/go-simple-grpc/product/productpb"
+	"github.com/nadirbasalamah/go-simple-grpc/repository"
+	"github.com/nadirbasalamah/go-simple-grpc/validation"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-// CreateProduct returns created product data
-func CreateProduct(product model.Product) (model.Product, error) {
-	_, err := database.DB.Query("INSERT INTO products (name, description, category, amount) VALUES ($1, $2, $3, $4) ", product.Name, product.Description, product.Category, product.Amount)
+// ProductService represents product business logic
+type ProductService struct {
+	repo      repository.ProductRepository
+	validator *validation.Validator
+	// idempotency stores the responses of the writes made with an idempotency key, nil
+	// disables idempotency keys
+	idempotency    repository.IdempotencyStore
+	idempotencyTTL time.Duration
+	// events receives the product changes, nil disables watching
+	events events.Feed
+	// writeMu serializes the writes with the publishing of their changes when the feed
+	// assigns the revisions
+	writeMu sync.Mutex
+}
+
+// NewProductService returns product service that stores data in the given repository
+// and checks the written products with the validator. The responses of writes made with
+// an idempotency key are kept in the idempotency store for idempotencyTTL, every product
+// change is published to the feed
+func NewProductService(repo repository.ProductRepository, validator *validation.Validator, idempotency repository.IdempotencyStore, idempotencyTTL time.Duration, feed events.Feed) *ProductService {
+	return &ProductService{repo: repo, validator: validator, idempotency: idempotency, idempotencyTTL: idempotencyTTL, events: feed}
+}
+
+// CreateProduct returns created product data, a retry with the same idempotencyKey returns
+// the product created by the first request
+func (s *ProductService) CreateProduct(ctx context.Context, product model.Product, idempotencyKey string) (model.Product, error) {
+	if violations := s.validator.Validate(product, nil); len(violations) > 0 {
+		return model.Product{}, invalidProduct(violations)
+	}
+
+	var createdProduct model.Product
+	err := s.idempotent(ctx, "CreateProduct", idempotencyKey, product, &createdProduct, func() error {
+		return s.write(func() error {
+			var err error
+			if createdProduct, err = s.repo.Create(ctx, product); err != nil {
+				return repositoryError(err, "insert data")
+			}
+			s.publish(events.Created, createdProduct)
+			return nil
+		})
+	})
 	if err != nil {
-		return model.Product{}, status.Errorf(
-			codes.Internal,
-			fmt.Sprintf("Internal error, insert data failed: %v", err),
-		)
+		return model.Product{}, err
+	}
+	return createdProduct, nil
+}
+
+// GetProduct returns specific product by id, a soft deleted product is only returned
+// when showDeleted is set
+func (s *ProductService) GetProduct(ctx context.Context, id int32, showDeleted bool) (model.Product, error) {
+	product, err := s.repo.Get(ctx, int(id), showDeleted)
+	if err != nil {
+		return model.Product{}, repositoryError(err, "retrieve data")
 	}
+	log.Println(product.Name, product.Description, product.Category, product.Amount)
 	return product, nil
 }
 
-// GetProduct returns specific product by id
-func GetProduct(id int32) (model.Product, error) {
-	product := model.Product{}
+// GetProductAsOf returns the product as it was at asOf, a product deleted at the time is
+// only returned when showDeleted is set
+func (s *ProductService) GetProductAsOf(ctx context.Context, id int32, asOf repository.AsOf, showDeleted bool) (model.Product, error) {
+	if asOf.Version < 0 || (asOf.Version == 0 && asOf.Time.IsZero()) {
+		return model.Product{}, status.Error(codes.InvalidArgument, "As of time or a positive version must be set")
+	}
 
-	row, err := database.DB.Query("SELECT * FROM products WHERE id = $1", id)
+	product, err := s.repo.GetAsOf(ctx, int(id), asOf)
 	if err != nil {
-		return model.Product{}, status.Errorf(
-			codes.Internal,
-			fmt.Sprintf("Internal error, data cannot be retrieved: %v", err),
-		)
+		return model.Product{}, repositoryError(err, "retrieve data")
 	}
+	if product.DeletedAt != nil && !showDeleted {
+		return model.Product{}, repositoryError(repository.ErrNotFound, "retrieve data")
+	}
+	return product, nil
+}
 
-	defer row.Close()
-
-	for row.Next() {
-		switch err := row.Scan(&product.ID, &product.Amount, &product.Name, &product.Description, &product.Category); err {
-		case sql.ErrNoRows:
+// EditProduct returns edited product data, only the fields in updateMask are changed
+// unless it is empty
+func (s *ProductService) EditProduct(ctx context.Context, product model.Product, id int32, updateMask []string) (model.Product, error) {
+	paths := map[string]bool{}
+	for _, path := range updateMask {
+		if !isProductField(path) {
 			return model.Product{}, status.Errorf(
-				codes.NotFound,
-				fmt.Sprintf("Data not found: %v", err),
+				codes.InvalidArgument,
+				fmt.Sprintf("Unknown update mask path: %s", path),
 			)
-		case nil:
-			log.Println(product.Name, product.Description, product.Category, product.Amount)
-		default:
+		}
+		if paths[path] {
 			return model.Product{}, status.Errorf(
-				codes.Internal,
-				fmt.Sprintf("Internal error, data cannot be retrieved: %v", err),
+				codes.InvalidArgument,
+				fmt.Sprintf("Duplicate update mask path: %s", path),
 			)
 		}
+		paths[path] = true
+	}
+	if violations := s.validator.Validate(product, updateMask); len(violations) > 0 {
+		return model.Product{}, invalidProduct(violations)
 	}
 
-	if product.ID == 0 {
-		return model.Product{}, status.Errorf(
-			codes.NotFound,
-			fmt.Sprintf("Data not found: %v", err),
-		)
+	var editedProduct model.Product
+	err := s.write(func() error {
+		var err error
+		if editedProduct, err = s.repo.Update(ctx, int(id), product, updateMask); err != nil {
+			return repositoryError(err, "update data")
+		}
+		s.publish(events.Updated, editedProduct)
+		return nil
+	})
+	if err != nil {
+		return model.Product{}, err
 	}
+	return editedProduct, nil
+}
 
-	return product, nil
+// RevertProduct restores the name, description, category and amount the product had at
+// the version, the product must have expectedVersion unless it is 0
+func (s *ProductService) RevertProduct(ctx context.Context, id int32, version int32, expectedVersion int32) (model.Product, error) {
+	if version <= 0 {
+		return model.Product{}, status.Error(codes.InvalidArgument, "Version must be positive")
+	}
+	// the version may have been written before the current validation rules
+	snapshot, err := s.repo.GetAsOf(ctx, int(id), repository.AsOf{Version: int(version)})
+	if err != nil {
+		return model.Product{}, repositoryError(err, "revert data")
+	}
+	if violations := s.validator.Validate(snapshot, nil); len(violations) > 0 {
+		return model.Product{}, invalidProduct(violations)
+	}
+
+	var revertedProduct model.Product
+	err = s.write(func() error {
+		var err error
+		if revertedProduct, err = s.repo.Revert(ctx, int(id), int(version), int(expectedVersion)); err != nil {
+			return repositoryError(err, "revert data")
+		}
+		s.publish(events.Updated, revertedProduct)
+		return nil
+	})
+	if err != nil {
+		return model.Product{}, err
+	}
+	return revertedProduct, nil
 }
 
-// EditProduct returns edited product data
-func EditProduct(product model.Product, id int32) (model.Product, error) {
-	_, err := database.DB.Query("UPDATE products SET name=$1, description=$2, category=$3, amount=$4 WHERE id=$5", product.Name, product.Description, product.Category, product.Amount, id)
+// DeleteProduct returns error occured when deleting a product data, the product must
+// have expectedVersion unless it is 0
+func (s *ProductService) DeleteProduct(ctx context.Context, id int32, expectedVersion int32) error {
+	return s.write(func() error {
+		deletedProduct, err := s.repo.Delete(ctx, int(id), int(expectedVersion))
+		if err != nil {
+			return repositoryError(err, "delete data")
+		}
+		s.publish(events.Deleted, deletedProduct)
+		return nil
+	})
+}
+
+// UpsertProduct creates the product or updates the product with the same name, and reports
+// whether it was created
+func (s *ProductService) UpsertProduct(ctx context.Context, product model.Product) (model.Product, bool, error) {
+	if violations := s.validator.Validate(product, nil); len(violations) > 0 {
+		return model.Product{}, false, invalidProduct(violations)
+	}
+
+	var upsertedProduct model.Product
+	var created bool
+	err := s.write(func() error {
+		var err error
+		if upsertedProduct, created, err = s.repo.UpsertByName(ctx, product); err != nil {
+			return repositoryError(err, "upsert data")
+		}
+		if created {
+			s.publish(events.Created, upsertedProduct)
+		} else {
+			s.publish(events.Updated, upsertedProduct)
+		}
+		return nil
+	})
 	if err != nil {
-		return model.Product{}, status.Errorf(
-			codes.Internal,
-			fmt.Sprintf("Internal error, update data failed: %v", err),
-		)
+		return model.Product{}, false, err
+	}
+	return upsertedProduct, created, nil
+}
+
+// UndeleteProduct returns the restored soft deleted product
+func (s *ProductService) UndeleteProduct(ctx context.Context, id int32) (model.Product, error) {
+	var product model.Product
+	err := s.write(func() error {
+		var err error
+		if product, err = s.repo.Undelete(ctx, int(id)); err != nil {
+			return repositoryError(err, "restore data")
+		}
+		s.publish(events.Updated, product)
+		return nil
+	})
+	if err != nil {
+		return model.Product{}, err
 	}
 	return product, nil
 }
 
-// DeleteProduct returns error occured when deleting a product data
-func DeleteProduct(id int32) error {
-	_, err := database.DB.Query("DELETE FROM products WHERE id = $1", id)
+// PurgeDeletedProducts permanently removes the products deleted for longer than olderThan
+// and returns how many were removed
+func (s *ProductService) PurgeDeletedProducts(ctx context.Context, olderThan time.Duration) (int, error) {
+	if olderThan < 0 {
+		return 0, status.Error(codes.InvalidArgument, "Purge age must not be negative")
+	}
+
+	purged, err := s.repo.PurgeDeleted(ctx, time.Now().Add(-olderThan))
 	if err != nil {
-		return status.Errorf(
-			codes.Internal,
-			fmt.Sprintf("Internal error, delete data failed: %v", err),
-		)
+		return 0, repositoryError(err, "purge data")
 	}
+	return purged, nil
+}
+
+// ListProducts returns a page of products matching the query, the token of the next page
+// and the number of matching products
+func (s *ProductService) ListProducts(ctx context.Context, query model.ProductQuery) (repository.ListResult, string, error) {
+	if query.PageSize == 0 {
+		query.PageSize = defaultPageSize
+	}
+	if query.PageSize > maxPageSize {
+		query.PageSize = maxPageSize
+	}
+	return s.listProducts(ctx, query)
+}
+
+// GetProducts streams the products matching the query, all of them when no page size is set.
+// An empty result is an empty stream, the number of matching products is sent in the
+// total-count trailer
+func (s *ProductService) GetProducts(query model.ProductQuery, stream productpb.ProductService_GetProductsServer) error {
+	result, nextPageToken, err := s.listProducts(stream.Context(), query)
+	if err != nil {
+		return err
+	}
+
+	trailer := metadata.Pairs("total-count", strconv.Itoa(result.TotalCount))
+	if nextPageToken != "" {
+		trailer.Set("next-page-token", nextPageToken)
+	}
+	stream.SetTrailer(trailer)
+
+	for i := range result.Products {
+		err := stream.Send(&productpb.GetProductsResponse{
+			Product: dataToProductPb(&result.Products[i]),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-// GetProducts returns all product data
-func GetProducts(stream productpb.ProductService_GetProductsServer) error {
-	rows, err := database.DB.Query("SELECT id, name, description, category, amount FROM products ORDER BY name")
+// SearchProducts returns a page of the products matching the keywords of the query, the
+// most relevant first, and the token of the next page
+func (s *ProductService) SearchProducts(ctx context.Context, query model.SearchQuery) (repository.SearchResult, string, error) {
+	if strings.TrimSpace(query.Query) == "" {
+		return repository.SearchResult{}, "", status.Error(codes.InvalidArgument, "Search query must not be empty")
+	}
+	switch {
+	case query.PageSize < 0:
+		return repository.SearchResult{}, "", status.Error(codes.InvalidArgument, "Page size must not be negative")
+	case query.PageSize == 0:
+		query.PageSize = defaultSearchPageSize
+	case query.PageSize > maxSearchPageSize:
+		query.PageSize = maxSearchPageSize
+	}
+
+	opts := repository.SearchOptions{Query: query.Query, Category: query.Category, Limit: query.PageSize}
+	if query.PageToken != "" {
+		offset, err := decodeSearchPageToken(query)
+		if err != nil {
+			return repository.SearchResult{}, "", status.Error(codes.InvalidArgument, err.Error())
+		}
+		opts.Offset = offset
+	}
+
+	result, err := s.repo.Search(ctx, opts)
+	if err != nil {
+		return repository.SearchResult{}, "", repositoryError(err, "search data")
+	}
+
+	nextPageToken := ""
+	if result.HasMore {
+		nextPageToken = encodeSearchPageToken(query, opts.Offset+len(result.Hits))
+	}
+	return result, nextPageToken, nil
+}
+
+// ListProductHistory returns a page of the recorded changes of the product, the latest first,
+// and the token of the next page
+func (s *ProductService) ListProductHistory(ctx context.Context, query model.HistoryQuery) (repository.HistoryResult, string, error) {
+	switch {
+	case query.PageSize < 0:
+		return repository.HistoryResult{}, "", status.Error(codes.InvalidArgument, "Page size must not be negative")
+	case query.PageSize == 0:
+		query.PageSize = defaultPageSize
+	case query.PageSize > maxPageSize:
+		query.PageSize = maxPageSize
+	}
+
+	opts := repository.HistoryOptions{Limit: query.PageSize}
+	if query.PageToken != "" {
+		lastID, err := decodeHistoryPageToken(query)
+		if err != nil {
+			return repository.HistoryResult{}, "", status.Error(codes.InvalidArgument, err.Error())
+		}
+		opts.BeforeID = lastID
+	}
+
+	result, err := s.repo.ProductHistory(ctx, query.ProductID, opts)
 	if err != nil {
+		return repository.HistoryResult{}, "", repositoryError(err, "retrieve history")
+	}
+	// a purged product keeps its history, a product without history may predate the audit log
+	if len(result.Entries) == 0 && opts.BeforeID == 0 {
+		if _, err := s.repo.Get(ctx, query.ProductID, true); err != nil {
+			return repository.HistoryResult{}, "", repositoryError(err, "retrieve data")
+		}
+	}
+
+	nextPageToken := ""
+	if result.HasMore {
+		nextPageToken = encodeHistoryPageToken(query, result.Entries[len(result.Entries)-1].ID)
+	}
+	return result, nextPageToken, nil
+}
+
+// WatchProducts sends the product events published after afterRevision, or from now on
+// when it is 0, until the stream is closed. Only the events of products in one of the
+// categories are sent unless categories is empty
+func (s *ProductService) WatchProducts(afterRevision int64, categories []string, stream productpb.ProductService_WatchProductsServer) error {
+	if s.events == nil {
+		return status.Error(codes.Unimplemented, "Watching products is not enabled")
+	}
+	if afterRevision < 0 {
+		return status.Error(codes.InvalidArgument, "Revision must not be negative")
+	}
+
+	var filter func(events.Event) bool
+	if len(categories) > 0 {
+		filter = func(event events.Event) bool {
+			for _, category := range categories {
+				if event.Product.Category == category {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	sub, revision, err := s.events.Subscribe(afterRevision, filter)
+	switch err {
+	case nil:
+	case events.ErrRevisionCompacted, events.ErrFutureRevision:
 		return status.Errorf(
-			codes.Internal,
-			fmt.Sprintf("Internal error, data cannot be retrieved: %v", err),
+			codes.OutOfRange,
+			fmt.Sprintf("Cannot resume after revision %d: %v, list the products again and watch from revision 0", afterRevision, err),
 		)
+	default:
+		return status.Errorf(codes.Internal, fmt.Sprintf("Internal error, watch failed: %v", err))
 	}
+	defer sub.Close()
 
-	defer rows.Close()
-	result := model.Products{}
-	for rows.Next() {
-		product := model.Product{}
-		err := rows.Scan(&product.ID, &product.Name, &product.Description, &product.Category, &product.Amount)
-		if err != nil {
-			return status.Errorf(
-				codes.Internal,
-				fmt.Sprintf("Internal error: %v", err),
-			)
+	// the header tells the client the revision its watch starts from, the events after it are
+	// all queued on the subscription
+	if err := stream.SendHeader(metadata.Pairs("revision", strconv.FormatInt(revision, 10))); err != nil {
+		return err
+	}
+
+	lastRevision := afterRevision
+	for {
+		select {
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case event, ok := <-sub.Events():
+			if !ok {
+				return watchStopped(sub.Err(), lastRevision)
+			}
+			if err := stream.Send(eventToPb(event)); err != nil {
+				return err
+			}
+			lastRevision = event.Revision
 		}
-		result.Products = append(result.Products, product)
-		stream.Send(&productpb.GetProductsResponse{
-			Product: dataToProductPb(&product),
-		})
 	}
+}
 
-	if len(result.Products) == 0 {
+// watchStopped returns the error of a watch whose subscription was closed by the feed
+func watchStopped(err error, lastRevision int64) error {
+	switch err {
+	case events.ErrSlowSubscriber:
 		return status.Errorf(
-			codes.NotFound,
-			fmt.Sprintf("Products not found: %v", err),
+			codes.ResourceExhausted,
+			fmt.Sprintf("Watch stopped: %v, resume after revision %d", err, lastRevision),
+		)
+	case events.ErrEventsLost:
+		return status.Errorf(
+			codes.OutOfRange,
+			fmt.Sprintf("Watch stopped: %v, list the products again and watch from revision 0", err),
+		)
+	default:
+		return status.Errorf(
+			codes.Unavailable,
+			fmt.Sprintf("Watch stopped: %v, resume after revision %d", err, lastRevision),
 		)
 	}
+}
 
-	return nil
+func (s *ProductService) listProducts(ctx context.Context, query model.ProductQuery) (repository.ListResult, string, error) {
+	if query.PageSize < 0 {
+		return repository.ListResult{}, "", status.Error(codes.InvalidArgument, "Page size must not be negative")
+	}
+
+	opts := repository.ListOptions{
+		Filter:     query.Filter,
+		SortBy:     query.SortBy,
+		Descending: query.Descending,
+		Limit:      query.PageSize,
+	}
+	if query.PageToken != "" {
+		after, err := decodePageToken(query)
+		if err != nil {
+			return repository.ListResult{}, "", status.Error(codes.InvalidArgument, err.Error())
+		}
+		opts.After = &after
+	}
+
+	result, err := s.repo.List(ctx, opts)
+	if err != nil {
+		return repository.ListResult{}, "", repositoryError(err, "retrieve data")
+	}
+
+	nextPageToken := ""
+	if result.HasMore {
+		nextPageToken = encodePageToken(query, result.Products[len(result.Products)-1])
+	}
+	return result, nextPageToken, nil
+}
+
+// BatchItemResult represents the outcome of a single product of a batch
+type BatchItemResult struct {
+	Index   int
+	Product model.Product
+	Created bool
+	Code    codes.Code
+	Message string
+}
+
+// CreateBatchProduct returns the result of each product of the batch, in atomic mode
+// either all the products are created or none of them. A retry with the same idempotencyKey
+// returns the results of the first request
+func (s *ProductService) CreateBatchProduct(ctx context.Context, products []model.Product, atomic bool, idempotencyKey string) ([]BatchItemResult, error) {
+	request := struct {
+		Products []model.Product
+		Atomic   bool
+	}{products, atomic}
+
+	var results []BatchItemResult
+	err := s.idempotent(ctx, "CreateBatchProduct", idempotencyKey, request, &results, func() error {
+		return s.write(func() error {
+			var err error
+			results, err = s.writeBatch(products, atomic, func(valid []model.Product) ([]repository.BatchResult, error) {
+				return s.repo.BatchCreate(ctx, valid, atomic)
+			})
+			if err != nil {
+				return repositoryError(err, "insert batch")
+			}
+			s.publishBatch(results)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// UpsertProducts updates the products that have an id and creates the others,
+// returning the result of each of them
+func (s *ProductService) UpsertProducts(ctx context.Context, products []model.Product) ([]BatchItemResult, error) {
+	var results []BatchItemResult
+	err := s.write(func() error {
+		var err error
+		results, err = s.writeBatch(products, false, func(valid []model.Product) ([]repository.BatchResult, error) {
+			return s.repo.BatchUpsert(ctx, valid)
+		})
+		if err != nil {
+			return repositoryError(err, "upsert batch")
+		}
+		s.publishBatch(results)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// writeBatch validates the products and passes the valid ones to write, the results are
+// returned in the order of products. In atomic mode nothing is written when a product is invalid
+func (s *ProductService) writeBatch(products []model.Product, atomic bool, write func([]model.Product) ([]repository.BatchResult, error)) ([]BatchItemResult, error) {
+	results := make([]BatchItemResult, len(products))
+	valid := []model.Product{}
+	validIndexes := []int{}
+	for i, product := range products {
+		results[i].Index = i
+		if violations := s.validator.Validate(product, nil); len(violations) > 0 {
+			results[i].Code, results[i].Message = codes.InvalidArgument, validation.Message(violations)
+			continue
+		}
+		valid = append(valid, product)
+		validIndexes = append(validIndexes, i)
+	}
+
+	if atomic && len(valid) < len(products) {
+		for _, i := range validIndexes {
+			results[i].Code, results[i].Message = codes.Aborted, repository.ErrBatchAborted.Error()
+		}
+		return results, nil
+	}
+	if len(valid) == 0 {
+		return results, nil
+	}
+
+	written, err := write(valid)
+	if err != nil {
+		return nil, err
+	}
+	for j, result := range batchItemResults(written) {
+		result.Index = validIndexes[j]
+		results[result.Index] = result
+	}
+	return results, nil
+}
+
+func batchItemResults(results []repository.BatchResult) []BatchItemResult {
+	itemResults := []BatchItemResult{}
+	for i, result := range results {
+		itemResult := BatchItemResult{Index: i, Product: result.Product, Created: result.Created, Code: codes.OK}
+		if result.Err != nil {
+			st := status.Convert(repositoryError(result.Err, "write data"))
+			itemResult.Code, itemResult.Message = st.Code(), st.Message()
+		}
+		itemResults = append(itemResults, itemResult)
+	}
+	return itemResults
+}
+
+// write runs fn, which writes to the repository and publishes the changes. When the feed
+// assigns the revisions the writes are serialized with their publishing, so the revisions
+// follow the order of the writes. The memory and SQLite storages serialize the writes anyway
+func (s *ProductService) write(fn func() error) error {
+	if s.events != nil && s.events.AssignsRevisions() {
+		s.writeMu.Lock()
+		defer s.writeMu.Unlock()
+	}
+	return fn()
+}
+
+// publish sends the change of the product to the watchers
+func (s *ProductService) publish(eventType events.Type, product model.Product) {
+	if s.events != nil {
+		s.events.Publish(eventType, product)
+	}
+}
+
+// publishBatch sends the changes of the written products of the batch to the watchers
+func (s *ProductService) publishBatch(results []BatchItemResult) {
+	for _, result := range results {
+		switch {
+		case result.Code != codes.OK:
+		case result.Created:
+			s.publish(events.Created, result.Product)
+		default:
+			s.publish(events.Updated, result.Product)
+		}
+	}
+}
+
+// invalidProduct returns InvalidArgument error with the violations as BadRequest details
+func invalidProduct(violations []validation.Violation) error {
+	badRequest := &errdetails.BadRequest{}
+	for _, violation := range violations {
+		badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       "product." + violation.Field,
+			Description: violation.Description,
+		})
+	}
+
+	return withDetails(status.New(codes.InvalidArgument, fmt.Sprintf("Invalid product: %s", validation.Message(violations))), badRequest)
+}
+
+func isProductField(field string) bool {
+	for _, f := range model.ProductFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
 }
 
 func dataToProductPb(data *model.Product) *productpb.Product {
@@ -133,5 +629,28 @@ func dataToProductPb(data *model.Product) *productpb.Product {
 		Description: data.Description,
 		Category:    data.Category,
 		Amount:      int32(data.Amount),
+		Version:     int32(data.Version),
+		DeletedAt:   deletedAtToPb(data.DeletedAt),
+	}
+}
+
+func eventToPb(event events.Event) *productpb.ProductEvent {
+	eventTypes := map[events.Type]productpb.EventType{
+		events.Created: productpb.EventType_EVENT_TYPE_CREATED,
+		events.Updated: productpb.EventType_EVENT_TYPE_UPDATED,
+		events.Deleted: productpb.EventType_EVENT_TYPE_DELETED,
+	}
+	return &productpb.ProductEvent{
+		Revision: event.Revision,
+		Type:     eventTypes[event.Type],
+		Product:  dataToProductPb(&event.Product),
+		Time:     timestamppb.New(event.Time),
+	}
+}
+
+func deletedAtToPb(deletedAt *time.Time) *timestamppb.Timestamp {
+	if deletedAt == nil {
+		return nil
 	}
+	return timestamppb.New(*deletedAt)
 }
@@ -0,0 +1,507 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nadirbasalamah/go-simple-grpc/events"
+	"github.com/nadirbasalamah/go-simple-grpc/model"
+	"github.com/nadirbasalamah/go-simple-grpc/repository"
+	"github.com/nadirbasalamah/go-simple-grpc/validation"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestService(t *testing.T) (*ProductService, model.Product) {
+	t.Helper()
+	repo := repository.NewMemoryRepository()
+	s := NewProductService(repo, validation.New(validation.ProductRules(nil)), repo, time.Hour, events.NewBroker(10, 10))
+	product, err := s.CreateProduct(context.Background(), model.Product{
+		Name:        "Sample product",
+		Description: "A sample product",
+		Category:    "Gadget",
+		Amount:      100,
+	}, "")
+	if err != nil {
+		t.Fatalf("CreateProduct() error = %v", err)
+	}
+	return s, product
+}
+
+func TestEditProduct(t *testing.T) {
+	s, product := newTestService(t)
+
+	edited, err := s.EditProduct(context.Background(), model.Product{
+		Name:        "Sample edited product",
+		Description: "An edited product",
+		Category:    "Books",
+		Amount:      50,
+	}, int32(product.ID), nil)
+	if err != nil {
+		t.Fatalf("EditProduct() error = %v", err)
+	}
+
+	want := model.Product{ID: product.ID, Name: "Sample edited product", Description: "An edited product", Category: "Books", Amount: 50, Version: 2}
+	if edited != want {
+		t.Errorf("EditProduct() = %+v, want %+v", edited, want)
+	}
+
+	stored, err := s.GetProduct(context.Background(), int32(product.ID), false)
+	if err != nil {
+		t.Fatalf("GetProduct() error = %v", err)
+	}
+	if stored != want {
+		t.Errorf("GetProduct() = %+v, want %+v", stored, want)
+	}
+}
+
+func TestEditProductNotFound(t *testing.T) {
+	s, product := newTestService(t)
+
+	_, err := s.EditProduct(context.Background(), model.Product{Name: "Missing", Category: "Books"}, int32(product.ID+1), nil)
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("EditProduct() code = %v, want %v", code, codes.NotFound)
+	}
+}
+
+func TestEditProductUpdateMask(t *testing.T) {
+	s, product := newTestService(t)
+
+	edited, err := s.EditProduct(context.Background(), model.Product{Amount: 25}, int32(product.ID), []string{"amount"})
+	if err != nil {
+		t.Fatalf("EditProduct() error = %v", err)
+	}
+
+	want := product
+	want.Amount = 25
+	want.Version = 2
+	if edited != want {
+		t.Errorf("EditProduct() = %+v, want %+v", edited, want)
+	}
+}
+
+func TestEditProductUnknownMaskPath(t *testing.T) {
+	s, product := newTestService(t)
+
+	_, err := s.EditProduct(context.Background(), model.Product{}, int32(product.ID), []string{"amount", "price"})
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Errorf("EditProduct() code = %v, want %v", code, codes.InvalidArgument)
+	}
+}
+
+func TestEditProductDuplicateMaskPath(t *testing.T) {
+	s, product := newTestService(t)
+
+	_, err := s.EditProduct(context.Background(), model.Product{Amount: 25}, int32(product.ID), []string{"amount", "amount"})
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Errorf("EditProduct() code = %v, want %v", code, codes.InvalidArgument)
+	}
+}
+
+func TestEditProductVersionMismatch(t *testing.T) {
+	s, product := newTestService(t)
+
+	stale := product
+	stale.Amount = 10
+	if _, err := s.EditProduct(context.Background(), stale, int32(product.ID), []string{"amount"}); err != nil {
+		t.Fatalf("EditProduct() error = %v", err)
+	}
+
+	stale.Amount = 20
+	_, err := s.EditProduct(context.Background(), stale, int32(product.ID), []string{"amount"})
+	if code := status.Code(err); code != codes.Aborted {
+		t.Errorf("EditProduct() with stale version code = %v, want %v", code, codes.Aborted)
+	}
+}
+
+func TestDeleteProductVersionMismatch(t *testing.T) {
+	s, product := newTestService(t)
+
+	err := s.DeleteProduct(context.Background(), int32(product.ID), int32(product.Version+1))
+	if code := status.Code(err); code != codes.Aborted {
+		t.Errorf("DeleteProduct() with stale version code = %v, want %v", code, codes.Aborted)
+	}
+
+	if err := s.DeleteProduct(context.Background(), int32(product.ID), int32(product.Version)); err != nil {
+		t.Errorf("DeleteProduct() error = %v", err)
+	}
+}
+
+func TestDeleteProduct(t *testing.T) {
+	s, product := newTestService(t)
+
+	if err := s.DeleteProduct(context.Background(), int32(product.ID), 0); err != nil {
+		t.Fatalf("DeleteProduct() error = %v", err)
+	}
+
+	_, err := s.GetProduct(context.Background(), int32(product.ID), false)
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("GetProduct() after delete code = %v, want %v", code, codes.NotFound)
+	}
+}
+
+func TestDeleteProductNotFound(t *testing.T) {
+	s, product := newTestService(t)
+
+	err := s.DeleteProduct(context.Background(), int32(product.ID+1), 0)
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("DeleteProduct() code = %v, want %v", code, codes.NotFound)
+	}
+}
+
+func TestUndeleteProduct(t *testing.T) {
+	ctx := context.Background()
+	s, product := newTestService(t)
+
+	if _, err := s.UndeleteProduct(ctx, int32(product.ID)); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("UndeleteProduct() of a product that is not deleted code = %v, want %v", status.Code(err), codes.FailedPrecondition)
+	}
+
+	if err := s.DeleteProduct(ctx, int32(product.ID), 0); err != nil {
+		t.Fatalf("DeleteProduct() error = %v", err)
+	}
+	deleted, err := s.GetProduct(ctx, int32(product.ID), true)
+	if err != nil {
+		t.Fatalf("GetProduct() with show deleted error = %v", err)
+	}
+	if deleted.DeletedAt == nil {
+		t.Errorf("GetProduct() with show deleted DeletedAt = nil, want deletion time")
+	}
+
+	restored, err := s.UndeleteProduct(ctx, int32(product.ID))
+	if err != nil {
+		t.Fatalf("UndeleteProduct() error = %v", err)
+	}
+	if restored.DeletedAt != nil || restored.Version != product.Version+2 {
+		t.Errorf("UndeleteProduct() = %+v, want restored product with version %d", restored, product.Version+2)
+	}
+	if _, err := s.GetProduct(ctx, int32(product.ID), false); err != nil {
+		t.Errorf("GetProduct() after undelete error = %v", err)
+	}
+}
+
+func TestPurgeDeletedProducts(t *testing.T) {
+	ctx := context.Background()
+	s, product := newTestService(t)
+
+	if err := s.DeleteProduct(ctx, int32(product.ID), 0); err != nil {
+		t.Fatalf("DeleteProduct() error = %v", err)
+	}
+
+	if purged, err := s.PurgeDeletedProducts(ctx, time.Hour); err != nil || purged != 0 {
+		t.Errorf("PurgeDeletedProducts(1h) = %d, %v, want 0, nil", purged, err)
+	}
+	if purged, err := s.PurgeDeletedProducts(ctx, 0); err != nil || purged != 1 {
+		t.Errorf("PurgeDeletedProducts(0) = %d, %v, want 1, nil", purged, err)
+	}
+	if _, err := s.UndeleteProduct(ctx, int32(product.ID)); status.Code(err) != codes.NotFound {
+		t.Errorf("UndeleteProduct() after purge code = %v, want %v", status.Code(err), codes.NotFound)
+	}
+}
+
+func TestCreateProductInvalid(t *testing.T) {
+	s := NewProductService(repository.NewMemoryRepository(), validation.New(validation.ProductRules([]string{"Gadget"})), nil, 0, nil)
+
+	_, err := s.CreateProduct(context.Background(), model.Product{Name: " ", Category: "Books", Amount: -1}, "")
+	st := status.Convert(err)
+	if st.Code() != codes.InvalidArgument {
+		t.Fatalf("CreateProduct() code = %v, want %v", st.Code(), codes.InvalidArgument)
+	}
+
+	fields := []string{}
+	for _, detail := range st.Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			for _, violation := range badRequest.GetFieldViolations() {
+				fields = append(fields, violation.GetField())
+			}
+		}
+	}
+	want := []string{"product.name", "product.category", "product.amount"}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("CreateProduct() field violations = %v, want %v", fields, want)
+	}
+}
+
+func TestCreateBatchProductInvalid(t *testing.T) {
+	s, _ := newTestService(t)
+	products := []model.Product{
+		{Name: "Valid product", Category: "Books"},
+		{Name: "Invalid product", Category: "Books", Amount: -1},
+	}
+
+	results, err := s.CreateBatchProduct(context.Background(), products, true, "")
+	if err != nil {
+		t.Fatalf("CreateBatchProduct() error = %v", err)
+	}
+	if results[0].Code != codes.Aborted || results[1].Code != codes.InvalidArgument {
+		t.Errorf("CreateBatchProduct() atomic codes = %v, %v, want %v, %v", results[0].Code, results[1].Code, codes.Aborted, codes.InvalidArgument)
+	}
+
+	results, err = s.CreateBatchProduct(context.Background(), products, false, "")
+	if err != nil {
+		t.Fatalf("CreateBatchProduct() error = %v", err)
+	}
+	if results[0].Code != codes.OK || results[0].Product.ID == 0 || results[1].Code != codes.InvalidArgument {
+		t.Errorf("CreateBatchProduct() best-effort results = %+v", results)
+	}
+}
+
+func TestRepositoryError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want codes.Code
+	}{
+		{"not found", repository.ErrNotFound, codes.NotFound},
+		{"duplicate", &repository.Error{Kind: repository.Duplicate, Err: errors.New(`pq: duplicate key value violates unique constraint "products_name_key"`)}, codes.AlreadyExists},
+		{"invalid data", &repository.Error{Kind: repository.InvalidData, Column: "category", Err: errors.New(`pq: null value in column "category"`)}, codes.InvalidArgument},
+		{"conflict", &repository.Error{Kind: repository.Conflict, Err: errors.New("pq: could not serialize access")}, codes.Aborted},
+		{"unavailable", &repository.Error{Kind: repository.Unavailable, Err: errors.New("dial tcp 127.0.0.1:5432: connect: connection refused")}, codes.Unavailable},
+		{"unknown", errors.New(`pq: relation "products" does not exist`), codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := status.Convert(repositoryError(tt.err, "insert data"))
+			if st.Code() != tt.want {
+				t.Errorf("repositoryError() code = %v, want %v", st.Code(), tt.want)
+			}
+			if strings.Contains(st.Message(), "pq:") || strings.Contains(st.Message(), "dial tcp") {
+				t.Errorf("repositoryError() message = %q, leaks the database error", st.Message())
+			}
+		})
+	}
+}
+
+func TestCreateProductIdempotencyKey(t *testing.T) {
+	s, _ := newTestService(t)
+	ctx := context.Background()
+	product := model.Product{Name: "Idempotent product", Category: "Gadget", Amount: 10}
+
+	created, err := s.CreateProduct(ctx, product, "create-1")
+	if err != nil {
+		t.Fatalf("CreateProduct() error = %v", err)
+	}
+	retried, err := s.CreateProduct(ctx, product, "create-1")
+	if err != nil {
+		t.Fatalf("CreateProduct() retry error = %v", err)
+	}
+	if !reflect.DeepEqual(retried, created) {
+		t.Errorf("CreateProduct() retry = %+v, want %+v", retried, created)
+	}
+
+	product.Amount = 20
+	_, err = s.CreateProduct(ctx, product, "create-1")
+	if st := status.Convert(err); st.Code() != codes.InvalidArgument {
+		t.Errorf("CreateProduct() with changed request code = %v, want %v", st.Code(), codes.InvalidArgument)
+	}
+
+	_, err = s.CreateProduct(ctx, product, "create-2")
+	if st := status.Convert(err); st.Code() != codes.AlreadyExists {
+		t.Errorf("CreateProduct() with new key code = %v, want %v", st.Code(), codes.AlreadyExists)
+	}
+
+	// the keys of another caller are separate
+	otherCtx := repository.WithActor(ctx, repository.Actor{Identity: "bob"})
+	product.Name = "Other idempotent product"
+	other, err := s.CreateProduct(otherCtx, product, "create-1")
+	if err != nil {
+		t.Fatalf("CreateProduct() by other caller error = %v", err)
+	}
+	if other.ID == created.ID {
+		t.Errorf("CreateProduct() by other caller = %+v, want a new product", other)
+	}
+}
+
+func TestSearchProductsPagination(t *testing.T) {
+	s, _ := newTestService(t)
+	ctx := context.Background()
+	for _, name := range []string{"Sample lamp", "Sample desk", "Sample chair"} {
+		if _, err := s.CreateProduct(ctx, model.Product{Name: name, Category: "Gadget", Amount: 1}, ""); err != nil {
+			t.Fatalf("CreateProduct() error = %v", err)
+		}
+	}
+
+	query := model.SearchQuery{Query: "sample", PageSize: 3}
+	names := []string{}
+	for {
+		result, nextPageToken, err := s.SearchProducts(ctx, query)
+		if err != nil {
+			t.Fatalf("SearchProducts() error = %v", err)
+		}
+		for _, hit := range result.Hits {
+			names = append(names, hit.Product.Name)
+		}
+		if nextPageToken == "" {
+			break
+		}
+		query.PageToken = nextPageToken
+	}
+	if len(names) != 4 {
+		t.Errorf("SearchProducts() pages returned %v, want 4 products", names)
+	}
+
+	query.Category = "Books"
+	if _, _, err := s.SearchProducts(ctx, query); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("SearchProducts() with token of another category code = %v, want %v", status.Code(err), codes.InvalidArgument)
+	}
+}
+
+func TestCreateProductPublishesOnce(t *testing.T) {
+	s, _ := newTestService(t)
+	sub, _, err := s.events.Subscribe(0, nil)
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	defer sub.Close()
+
+	product := model.Product{Name: "Watched product", Category: "Gadget", Amount: 1}
+	for i := 0; i < 2; i++ {
+		if _, err := s.CreateProduct(context.Background(), product, "watched"); err != nil {
+			t.Fatalf("CreateProduct() error = %v", err)
+		}
+	}
+
+	if event := <-sub.Events(); event.Type != events.Created || event.Product.Name != product.Name {
+		t.Errorf("Events() = %+v, want created %s", event, product.Name)
+	}
+	select {
+	case event := <-sub.Events():
+		t.Errorf("Events() retried create published %+v", event)
+	default:
+	}
+}
+
+func TestConcurrentEditsPublishInOrder(t *testing.T) {
+	s, product := newTestService(t)
+	sub, _, err := s.events.Subscribe(0, nil)
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	defer sub.Close()
+
+	const edits = 8
+	var wg sync.WaitGroup
+	for i := 0; i < edits; i++ {
+		wg.Add(1)
+		go func(amount int) {
+			defer wg.Done()
+			if _, err := s.EditProduct(context.Background(), model.Product{Amount: amount}, int32(product.ID), []string{"amount"}); err != nil {
+				t.Errorf("EditProduct() error = %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// the revisions follow the versions the edits wrote
+	for version := product.Version + 1; version <= product.Version+edits; version++ {
+		if event := <-sub.Events(); event.Product.Version != version {
+			t.Errorf("Events() revision %d version = %d, want %d", event.Revision, event.Product.Version, version)
+		}
+	}
+}
+
+func TestListProductHistory(t *testing.T) {
+	s, product := newTestService(t)
+	ctx := repository.WithActor(context.Background(), repository.Actor{Identity: "alice", Peer: "127.0.0.1:5000"})
+
+	if _, err := s.EditProduct(ctx, model.Product{Amount: 80}, int32(product.ID), []string{"amount"}); err != nil {
+		t.Fatalf("EditProduct() error = %v", err)
+	}
+	if err := s.DeleteProduct(ctx, int32(product.ID), 0); err != nil {
+		t.Fatalf("DeleteProduct() error = %v", err)
+	}
+
+	query := model.HistoryQuery{ProductID: product.ID, PageSize: 2}
+	result, nextPageToken, err := s.ListProductHistory(ctx, query)
+	if err != nil {
+		t.Fatalf("ListProductHistory() error = %v", err)
+	}
+	if len(result.Entries) != 2 || result.Entries[0].Action != repository.AuditDeleted || result.Entries[1].Action != repository.AuditUpdated {
+		t.Fatalf("ListProductHistory() = %+v, want the delete then the edit", result.Entries)
+	}
+	edit := result.Entries[1]
+	wantChanges := []repository.FieldChange{{Field: "amount", Before: "100", After: "80"}}
+	if edit.Actor.Identity != "alice" || edit.Actor.Peer != "127.0.0.1:5000" || !reflect.DeepEqual(edit.Changes, wantChanges) {
+		t.Errorf("ListProductHistory() edit = %+v, want changes %+v by alice", edit, wantChanges)
+	}
+
+	query.PageToken = nextPageToken
+	result, nextPageToken, err = s.ListProductHistory(ctx, query)
+	if err != nil {
+		t.Fatalf("ListProductHistory() error = %v", err)
+	}
+	if len(result.Entries) != 1 || result.Entries[0].Action != repository.AuditCreated || nextPageToken != "" {
+		t.Errorf("ListProductHistory() last page = %+v, %q, want the create", result.Entries, nextPageToken)
+	}
+
+	if _, _, err := s.ListProductHistory(ctx, model.HistoryQuery{ProductID: -1}); status.Code(err) != codes.NotFound {
+		t.Errorf("ListProductHistory() of missing product code = %v, want %v", status.Code(err), codes.NotFound)
+	}
+}
+
+func TestGetProductAsOfAndRevert(t *testing.T) {
+	s, product := newTestService(t)
+	ctx := context.Background()
+	beforeEdit := time.Now()
+
+	if _, err := s.EditProduct(ctx, model.Product{Name: "Sample renamed product", Amount: 80}, int32(product.ID), []string{"name", "amount"}); err != nil {
+		t.Fatalf("EditProduct() error = %v", err)
+	}
+
+	old, err := s.GetProductAsOf(ctx, int32(product.ID), repository.AsOf{Time: beforeEdit}, false)
+	if err != nil {
+		t.Fatalf("GetProductAsOf() error = %v", err)
+	}
+	if old != product {
+		t.Errorf("GetProductAsOf() before the edit = %+v, want %+v", old, product)
+	}
+	if _, err := s.GetProductAsOf(ctx, int32(product.ID), repository.AsOf{Version: 3}, false); status.Code(err) != codes.NotFound {
+		t.Errorf("GetProductAsOf() of unknown version code = %v, want %v", status.Code(err), codes.NotFound)
+	}
+
+	if _, err := s.RevertProduct(ctx, int32(product.ID), 1, 1); status.Code(err) != codes.Aborted {
+		t.Errorf("RevertProduct() with stale version code = %v, want %v", status.Code(err), codes.Aborted)
+	}
+	reverted, err := s.RevertProduct(ctx, int32(product.ID), 1, 2)
+	if err != nil {
+		t.Fatalf("RevertProduct() error = %v", err)
+	}
+	want := product
+	want.Version = 3
+	if reverted != want {
+		t.Errorf("RevertProduct() = %+v, want %+v", reverted, want)
+	}
+
+	edited, err := s.GetProductAsOf(ctx, int32(product.ID), repository.AsOf{Version: 2}, false)
+	if err != nil {
+		t.Fatalf("GetProductAsOf() error = %v", err)
+	}
+	if edited.Name != "Sample renamed product" || edited.Amount != 80 {
+		t.Errorf("GetProductAsOf() version 2 = %+v, want the edited product", edited)
+	}
+}
+
+func TestRevertProductInvalid(t *testing.T) {
+	s, _ := newTestService(t)
+	ctx := context.Background()
+
+	// a version written before the validation rules
+	product, err := s.repo.Create(ctx, model.Product{Name: "Uncategorized product", Amount: 10})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := s.EditProduct(ctx, model.Product{Category: "Gadget"}, int32(product.ID), []string{"category"}); err != nil {
+		t.Fatalf("EditProduct() error = %v", err)
+	}
+
+	_, err = s.RevertProduct(ctx, int32(product.ID), 1, 0)
+	if st := status.Convert(err); st.Code() != codes.InvalidArgument {
+		t.Errorf("RevertProduct() to invalid version code = %v, want %v", st.Code(), codes.InvalidArgument)
+	}
+}
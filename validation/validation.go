@@ -0,0 +1,123 @@
+package validation
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/nadirbasalamah/go-simple-grpc/model"
+)
+
+const (
+	// MaxNameLength is the maximum number of characters of a product name
+	MaxNameLength = 100
+	// MaxDescriptionLength is the maximum number of characters of a product description
+	MaxDescriptionLength = 1000
+)
+
+// Rule checks a field value and returns the description of the violation, or an empty
+// string when the value is valid
+type Rule func(value interface{}) string
+
+// Rules represents the rules of every validated field
+type Rules map[string][]Rule
+
+// Violation represents a field that breaks one of its rules
+type Violation struct {
+	Field       string
+	Description string
+}
+
+// Required rejects blank strings
+func Required() Rule {
+	return func(value interface{}) string {
+		if s, ok := value.(string); ok && strings.TrimSpace(s) == "" {
+			return "must not be empty"
+		}
+		return ""
+	}
+}
+
+// MaxLength rejects strings longer than max characters
+func MaxLength(max int) Rule {
+	return func(value interface{}) string {
+		if s, ok := value.(string); ok && utf8.RuneCountInString(s) > max {
+			return fmt.Sprintf("must be at most %d characters", max)
+		}
+		return ""
+	}
+}
+
+// NonNegative rejects negative integers
+func NonNegative() Rule {
+	return func(value interface{}) string {
+		if n, ok := value.(int); ok && n < 0 {
+			return "must not be negative"
+		}
+		return ""
+	}
+}
+
+// OneOf rejects strings that are not in allowed, every value is accepted when allowed is empty
+func OneOf(allowed ...string) Rule {
+	return func(value interface{}) string {
+		s, ok := value.(string)
+		if !ok || len(allowed) == 0 {
+			return ""
+		}
+		for _, a := range allowed {
+			if s == a {
+				return ""
+			}
+		}
+		return fmt.Sprintf("must be one of %s", strings.Join(allowed, ", "))
+	}
+}
+
+// ProductRules returns the rules of the product fields, categories limits the allowed
+// categories unless it is empty
+func ProductRules(categories []string) Rules {
+	return Rules{
+		"name":        {Required(), MaxLength(MaxNameLength)},
+		"description": {MaxLength(MaxDescriptionLength)},
+		"category":    {Required(), OneOf(categories...)},
+		"amount":      {NonNegative()},
+	}
+}
+
+// Validator checks products against a set of rules
+type Validator struct {
+	rules Rules
+}
+
+// New returns validator that applies the given rules
+func New(rules Rules) *Validator {
+	return &Validator{rules: rules}
+}
+
+// Validate returns the violations of the given fields of the product, every field is
+// checked when none is given
+func (v *Validator) Validate(product model.Product, fields []string) []Violation {
+	if len(fields) == 0 {
+		fields = model.ProductFields
+	}
+
+	violations := []Violation{}
+	for _, field := range fields {
+		for _, rule := range v.rules[field] {
+			if description := rule(product.FieldValue(field)); description != "" {
+				violations = append(violations, Violation{Field: field, Description: description})
+			}
+		}
+	}
+	return violations
+}
+
+// Message returns a single line description of the violations
+func Message(violations []Violation) string {
+	descriptions := []string{}
+	for _, violation := range violations {
+		descriptions = append(descriptions, violation.Field+" "+violation.Description)
+	}
+	return strings.Join(descriptions, "; ")
+}